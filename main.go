@@ -27,22 +27,57 @@ func main() {
 	}
 
 	// create priam object
-	p := priam.New(config)
+	p, err := priam.New(config)
+	if err != nil {
+		glog.Error(err)
+		os.Exit(1)
+	}
 
 	// parse and run command
 	switch flag.Arg(0) {
 	case "backup":
-		if err := p.Backup(); err != nil {
+		if err := p.BackupKeyspaces(); err != nil {
 			glog.Error(err)
 			os.Exit(1)
 		}
 		glog.Infof("backup completed")
 	case "restore":
-		if err := p.Restore(); err != nil {
+		if err := p.EachKeyspace((*priam.Priam).Restore); err != nil {
 			glog.Error(err)
 			os.Exit(1)
 		}
 		glog.Infof("restore completed")
+	case "verify":
+		if err := p.EachKeyspace((*priam.Priam).Verify); err != nil {
+			glog.Error(err)
+			os.Exit(1)
+		}
+		glog.Infof("verify completed")
+	case "prune":
+		if err := p.EachKeyspace((*priam.Priam).Prune); err != nil {
+			glog.Error(err)
+			os.Exit(1)
+		}
+	case "delete":
+		if err := p.EachKeyspace((*priam.Priam).Delete); err != nil {
+			glog.Error(err)
+			os.Exit(1)
+		}
+	case "archive-commitlog":
+		if err := p.ArchiveCommitlog(); err != nil {
+			glog.Error(err)
+			os.Exit(1)
+		}
+	case "clear-restore-point":
+		if err := p.ClearRestorePoint(); err != nil {
+			glog.Error(err)
+			os.Exit(1)
+		}
+	case "consolidate":
+		if err := p.EachKeyspace((*priam.Priam).Consolidate); err != nil {
+			glog.Error(err)
+			os.Exit(1)
+		}
 	case "history":
 		if err := p.History(); err != nil {
 			glog.Error(err)
@@ -61,27 +96,77 @@ USAGE: go-priam [OPTIONS] COMMAND
 
 COMMAND
 
-	backup                  Backup cassandra DB to AWS S3 bucket.
+	backup                  Backup cassandra DB to storage (AWS S3 bucket by default).
 	restore                 Restore from a previous backup.
 	history                 Shows tree of all backups, including incremental backups.
+	verify                  Check that a backup is complete and not corrupt.
+	prune                   Delete backups not kept by the retention policy.
+	delete                  Delete a single backup.
+	archive-commitlog       Upload a commitlog segment, for use as archive_command.
+	clear-restore-point     Remove restore settings from commitlog_archiving.properties after replay.
+	consolidate             Build a full backup from an incremental backup and its parents.
 
 OPTIONS
 
 	-incremental            Switch to indicate incremental backup.
-	-aws-access-key         AWS Access Key ID to access S3.
+	-all-keyspaces          Work on all keyspaces.
+	-aws-access-key         AWS Access Key ID to access S3 (optional).
 	-aws-base-path          Base path to copy/restore files from S3.
 	-aws-bucket             S3 bucket name to store backups.
+	-aws-ca-cert            CA certificate to trust for the S3 endpoint.
+	-aws-endpoint           Custom endpoint URL for S3 compatible services.
+	-aws-external-id        External ID used when assuming aws-role-arn.
+	-aws-insecure-tls       Skip TLS certificate verification for the S3 endpoint.
+	-aws-path-style         Use path style addressing for S3 buckets.
+	-aws-profile            Profile in shared AWS config and credentials files.
 	-aws-region             Region of S3 account.
-	-aws-secret-key         AWS Secret Access key to access S3.
+	-aws-role-arn           ARN of IAM role to assume for S3 access.
+	-aws-secret-key         AWS Secret Access key to access S3 (optional).
+	-aws-sse                Server side encryption for uploads (s3, kms, customer).
+	-aws-sse-customer-key   File with base64 encoded key for customer provided encryption.
+	-aws-sse-kms-key-id     KMS key ID for kms server side encryption.
+	-aws-storage-class      S3 storage class for uploads, e.g. STANDARD_IA.
+	-aws-tags               Tags for uploads in the form key=value,key=value.
 	-cassandra-classpath    Directory where cassandra jar files are placed.
 	-cassandra-conf         Directory where cassandra conf files are placed.
+	-cascade                Also delete incremental backups depending on the deleted one.
+	-commitlog              Path of commitlog segment to archive.
+	-commitlog-restore-dir  Directory on cassandra hosts to stage commitlogs for replay in.
+	-compression            Compression for backup files (gzip, zstd, lz4, none).
+	-compression-level      Compression level, 0 picks the codec default.
 	-cqlsh-path             Path fo cqlsh.
+	-dedup                  Store each distinct data file once, shared between backups.
+	-download-parallelism   Number of files to download at once during restore.
+	-dry-run                Print what prune or delete would remove without removing it.
+	-encryption-key         File with base64 encoded master key for client side encryption.
+	-exclude-tables         Comma separated globs of tables to leave out of backup or restore.
+	-file-parallelism       Number of files per host to upload at once.
+	-format                 History output format (tree, json, yaml, table).
 	-host                   IP address of any one of the cassandra nodes.
+	-keep-daily             Keep the latest backup of each of this many days.
+	-keep-last              Keep this many latest full backups and their incrementals.
+	-keep-weekly            Keep the latest backup of each of this many weeks.
 	-keyspace               Cassandra keyspace to backup.
+	-keyspaces              Comma separated list of keyspaces to work on.
+	-loader                 How restore loads sstables (sstableloader, refresh).
+	-max-age                Keep backups younger than this, e.g. 30d or 720h.
+	-max-incremental-bytes-ratio
+	                        Take a full backup once incrementals exceed this ratio of the full backup size.
+	-max-incremental-chain  Take a full backup once this many incrementals are chained.
+	-mode                   How restore treats existing data (replace, additive).
 	-nodetool-path          Path to nodetool on the cassandra host.
+	-parallelism            Number of hosts to backup or restore at once.
 	-private-key            Path to private key used for password less ssh.
-	-snapshot               Restore to this timestamp.
+	-restore-auth           Recreate backed up roles and permissions when restoring.
+	-restore-time           Replay commitlogs up to this time after restoring.
+	-retries                Number of times to retry a failed download.
+	-snapshot               Restore, verify or delete this timestamp.
+	-storage                Storage backend to keep backups in (s3, local).
+	-storage-path           Directory to keep backups in for local storage.
 	-sstableloader          Path to sstableloader on cassandra hosts.
+	-system-keyspaces       Include system keyspaces in all-keyspaces.
+	-tables                 Comma separated globs of tables to backup or restore, all by default.
+	-target-keyspace        Restore into this keyspace instead of the backed up one.
 	-temp-dir               Temporary directory to download files to.
 	-user                   Usename for password less ssh to cassandra host.
 `)
@@ -10,14 +10,19 @@ import (
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
 )
 
+// maxSessions is the number of sessions sshd allows on one connection by
+// default (MaxSessions). Every file uploaded at once from a host takes one.
+const maxSessions = 10
+
 // Agent provides methods to run commands and interface with remote
-// cassandra cluster nodes via ssh.
-// TODO: add mutex to agent operations, to enable multi thread.
+// cassandra cluster nodes via ssh. It is safe for concurrent use.
 type Agent struct {
 	user       string
 	privateKey string
+	mu         sync.Mutex // protects clients
 	clients    map[string]*ssh.Client
 }
 
@@ -132,7 +137,10 @@ func (a *Agent) client(host string) (*ssh.Client, error) {
 		return nil, fmt.Errorf("empty cassandra host")
 	}
 
-	if session, ok := a.clients[host]; ok {
+	a.mu.Lock()
+	session, ok := a.clients[host]
+	a.mu.Unlock()
+	if ok {
 		return session, nil
 	}
 
@@ -158,6 +166,14 @@ func (a *Agent) client(host string) (*ssh.Client, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "error connecting to host %s", host)
 	}
+
+	// keep the first client if another goroutine connected meanwhile
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if existing, ok := a.clients[host]; ok {
+		client.Close()
+		return existing, nil
+	}
 	a.clients[host] = client
 	return client, nil
 }
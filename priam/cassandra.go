@@ -6,6 +6,7 @@ import (
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 	"os"
+	"path"
 	"regexp"
 	"strings"
 )
@@ -51,16 +52,216 @@ func (c *Cassandra) Hosts() []string {
 	return hosts
 }
 
-// SchemaBackup takes backup of a keyspace and saves it on remote machine
-func (c *Cassandra) SchemaBackup(host string) (string, error) {
-	file := fmt.Sprintf("/tmp/temp.schema")
-	cmd := fmt.Sprintf("echo 'DESCRIBE KEYSPACE %s' | %s > %s",
-		c.config.Keyspace, c.config.CqlshPath, file)
-	_, err := c.agent.Run(host, cmd)
+// Version returns the cassandra release version running on host.
+func (c *Cassandra) Version(host string) (string, error) {
+	bytes, err := c.agent.Run(host, c.nodetool("version"))
 	if err != nil {
-		return "", err
+		return "", errors.Wrapf(err,
+			"error getting version on host %s with output %s", host, bytes)
 	}
-	return file, nil
+	for _, line := range strings.Split(string(bytes), "\n") {
+		if strings.HasPrefix(line, "ReleaseVersion:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "ReleaseVersion:")), nil
+		}
+	}
+	return "", fmt.Errorf("no release version in output %s", bytes)
+}
+
+// Tokens returns the tokens owned by host.
+func (c *Cassandra) Tokens(host string) ([]string, error) {
+	bytes, err := c.agent.Run(host, c.nodetool("info -T"))
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"error getting tokens on host %s with output %s", host, bytes)
+	}
+	var tokens []string
+	for _, line := range strings.Split(string(bytes), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "Token" {
+			tokens = append(tokens, strings.TrimSpace(kv[1]))
+		}
+	}
+	return tokens, nil
+}
+
+// nodetool returns the command to run nodetool with given arguments.
+func (c *Cassandra) nodetool(args string) string {
+	return fmt.Sprintf(`CLASSPATH="%s/*" CASSANDRA_CONF=%s %s %s`,
+		c.config.CassandraClasspath, c.config.CassandraConf,
+		c.config.Nodetool, args)
+}
+
+// Keyspaces returns the names of all keyspaces of the cluster.
+func (c *Cassandra) Keyspaces(host string) ([]string, error) {
+	cmd := fmt.Sprintf("echo 'DESCRIBE KEYSPACES' | %s", c.config.CqlshPath)
+	bytes, err := c.agent.Run(host, cmd)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"error listing keyspaces on host %s with output %s", host, bytes)
+	}
+	return strings.Fields(string(bytes)), nil
+}
+
+// TableDir returns the live directory of table in keyspace on host,
+// looking through all of its data directories.
+func (c *Cassandra) TableDir(host, keyspace, table string) (string, error) {
+	dataDirs, err := c.hostDataDirs(host)
+	if err != nil {
+		return "", errors.Wrap(err, "error getting data dir from host")
+	}
+	for _, dataDir := range dataDirs {
+		dirs, err := c.agent.ListDirs(host, path.Join(dataDir, keyspace))
+		if err != nil {
+			continue
+		}
+		for _, dir := range dirs {
+			if tableIDPattern.MatchString(path.Base(dir)) && tableName(path.Base(dir)) == table {
+				return dir, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no directory for table %s.%s on host %s", keyspace, table, host)
+}
+
+// Refresh loads new sstables placed in the live directory of table on
+// host, as supported up to cassandra 3.x.
+func (c *Cassandra) Refresh(host, keyspace, table string) error {
+	cmd := c.nodetool(fmt.Sprintf("refresh %s %s", keyspace, table))
+	bytes, err := c.agent.Run(host, cmd)
+	if err != nil {
+		return errors.Wrapf(err,
+			"error refreshing %s.%s on host %s with output %s",
+			keyspace, table, host, bytes)
+	}
+	return nil
+}
+
+// Import loads sstables in dir on host into table, as supported from
+// cassandra 4.0.
+func (c *Cassandra) Import(host, keyspace, table, dir string) error {
+	cmd := c.nodetool(fmt.Sprintf("import %s %s %s", keyspace, table, dir))
+	bytes, err := c.agent.Run(host, cmd)
+	if err != nil {
+		return errors.Wrapf(err,
+			"error importing %s.%s on host %s with output %s",
+			keyspace, table, host, bytes)
+	}
+	return nil
+}
+
+// SchemaBackup saves the schema of the keyspace, including its user
+// defined types, functions and views, to a file on host and returns the
+// path of the file.
+func (c *Cassandra) SchemaBackup(host, ts string) (string, error) {
+	file := path.Join(c.config.TempDir, "remote", ts,
+		fmt.Sprintf("%s.schema", c.config.Keyspace))
+	return file, c.describe(host, fmt.Sprintf("KEYSPACE %s", c.config.Keyspace), file)
+}
+
+// FullSchemaBackup saves the schema of every keyspace of the cluster,
+// including system keyspaces, to a file on host and returns the path of
+// the file.
+func (c *Cassandra) FullSchemaBackup(host, ts string) (string, error) {
+	file := path.Join(c.config.TempDir, "remote", ts, fullSchemaName)
+	return file, c.describe(host, "FULL SCHEMA", file)
+}
+
+// describe writes the output of a cqlsh DESCRIBE statement to file on
+// host.
+func (c *Cassandra) describe(host, what, file string) error {
+	cmd := fmt.Sprintf("mkdir -p %s && echo 'DESCRIBE %s' | %s > %s",
+		path.Dir(file), what, c.config.CqlshPath, file)
+	bytes, err := c.agent.Run(host, cmd)
+	if err != nil {
+		return errors.Wrapf(err,
+			"error describing %s on host %s with output %s", what, host, bytes)
+	}
+	return nil
+}
+
+// DescribeKeyspace returns the schema of keyspace, or an empty string if
+// the keyspace does not exist. Any other failure of cqlsh is an error.
+func (c *Cassandra) DescribeKeyspace(host, keyspace string) (string, error) {
+	cmd := fmt.Sprintf("echo 'DESCRIBE KEYSPACE %s' | %s", keyspace, c.config.CqlshPath)
+	bytes, err := c.agent.Run(host, cmd)
+	if strings.Contains(string(bytes), fmt.Sprintf("Keyspace '%s' not found", keyspace)) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err,
+			"error describing keyspace %s on host %s with output %s",
+			keyspace, host, bytes)
+	}
+	return string(bytes), nil
+}
+
+// AuthBackup returns cql statements recreating the roles of the cluster,
+// their memberships and their permissions, as stored in system_auth.
+// Password hashes are kept, so restored roles log in as before.
+func (c *Cassandra) AuthBackup(host string) (string, error) {
+	var stmts []string
+	for _, table := range authTables {
+		cmd := fmt.Sprintf("echo 'SELECT JSON * FROM system_auth.%s;' | %s",
+			table, c.config.CqlshPath)
+		bytes, err := c.agent.Run(host, cmd)
+		if err != nil {
+			return "", errors.Wrapf(err,
+				"error reading system_auth.%s on host %s with output %s",
+				table, host, bytes)
+		}
+		stmts = append(stmts, authInserts(table, bytes)...)
+	}
+	return strings.Join(stmts, "\n") + "\n", nil
+}
+
+// authInserts returns an INSERT statement for every row of table in the
+// cqlsh output of a SELECT JSON query.
+func authInserts(table string, output []byte) []string {
+	var stmts []string
+	for _, line := range strings.Split(string(output), "\n") {
+		row := strings.TrimSpace(line)
+		if strings.HasPrefix(row, "{") {
+			stmts = append(stmts, fmt.Sprintf("INSERT INTO system_auth.%s JSON '%s';",
+				table, strings.Replace(row, "'", "''", -1)))
+		}
+	}
+	return stmts
+}
+
+// ClusterInfo returns the name, partitioner and snitch of the cluster as
+// seen from host.
+func (c *Cassandra) ClusterInfo(host string) (*ClusterInfo, error) {
+	bytes, err := c.agent.Run(host, c.nodetool("describecluster"))
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"error describing cluster on host %s with output %s", host, bytes)
+	}
+	return parseClusterInfo(bytes)
+}
+
+// parseClusterInfo returns the name, partitioner and snitch of the
+// cluster in the output of nodetool describecluster.
+func parseClusterInfo(output []byte) (*ClusterInfo, error) {
+	info := &ClusterInfo{}
+	for _, line := range strings.Split(string(output), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "Name":
+			info.Name = value
+		case "Partitioner":
+			info.Partitioner = value
+		case "Snitch":
+			info.Snitch = value
+		}
+	}
+	if info.Partitioner == "" {
+		return nil, fmt.Errorf("no partitioner in output %s", output)
+	}
+	return info, nil
 }
 
 // Snapshot takes incremental or full snapshot.
@@ -85,6 +286,37 @@ func (c *Cassandra) SnapshotFull(host, ts string) ([]string, []string, error) {
 	return c.snapshotFullFiles(host, ts)
 }
 
+// SnapshotKeyspaces takes one snapshot of several keyspaces on host.
+func (c *Cassandra) SnapshotKeyspaces(host, ts string, keyspaces []string) error {
+	cmd := c.nodetool(fmt.Sprintf("snapshot -t %s %s", ts, strings.Join(keyspaces, " ")))
+	bytes, err := c.agent.Run(host, cmd)
+	if err != nil {
+		return errors.Wrapf(err,
+			"error taking snapshot on host %s with output %s", host, bytes)
+	}
+	return nil
+}
+
+// ClearSnapshot removes the snapshot named ts of keyspaces on host.
+func (c *Cassandra) ClearSnapshot(host, ts string, keyspaces []string) error {
+	cmd := c.nodetool(fmt.Sprintf("clearsnapshot -t %s %s", ts, strings.Join(keyspaces, " ")))
+	bytes, err := c.agent.Run(host, cmd)
+	if err != nil {
+		return errors.Wrapf(err,
+			"error clearing snapshot %s on host %s with output %s", ts, host, bytes)
+	}
+	return nil
+}
+
+// SnapshotFiles returns the files to back up from a snapshot already
+// taken with SnapshotKeyspaces, incremental or full like Snapshot.
+func (c *Cassandra) SnapshotFiles(host, ts string) ([]string, []string, error) {
+	if c.config.Incremental {
+		return c.snapshotIncFiles(host)
+	}
+	return c.snapshotFullFiles(host, ts)
+}
+
 // Get files in snapshot
 func (c *Cassandra) snapshotFullFiles(host, ts string) ([]string, []string, error) {
 
@@ -114,6 +346,9 @@ func (c *Cassandra) snapshotFullFiles(host, ts string) ([]string, []string, erro
 				continue
 			}
 			dirs = append(dirs, snapshotDir)
+			if !c.backsUp(table) {
+				continue
+			}
 			for _, file := range f {
 				if file == "" {
 					continue
@@ -160,6 +395,10 @@ func (c *Cassandra) snapshotIncFiles(host string) ([]string, []string, error) {
 			if table == "" {
 				continue
 			}
+			// backups of other tables are kept for a later backup
+			if !c.backsUp(table) {
+				continue
+			}
 			snapshotDir := fmt.Sprintf("%s/backups/", table)
 			f, err := c.agent.ListFiles(host, snapshotDir)
 			if err != nil {
@@ -177,6 +416,13 @@ func (c *Cassandra) snapshotIncFiles(host string) ([]string, []string, error) {
 	return files, dirs, nil
 }
 
+// backsUp returns true if the table stored in directory dir is selected
+// by the tables and exclude-tables config parameters.
+func (c *Cassandra) backsUp(dir string) bool {
+	return tableSelected(tableName(path.Base(dir)),
+		splitList(c.config.Tables), splitList(c.config.ExcludeTables))
+}
+
 // cassandraConf ...
 type cassandraConf struct {
 	DataDirs []string `yaml:"data_file_directories"`
@@ -0,0 +1,198 @@
+package priam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Names of the cluster level schema artifacts stored next to the keyspace
+// schema of every snapshot.
+const (
+	fullSchemaName  = "cluster-schema.cql"
+	authName        = "auth.cql"
+	clusterInfoName = "cluster.json"
+)
+
+// authTables are the system_auth tables holding roles and grants, in the
+// order they are restored. The misspelt name is the one cassandra uses.
+var authTables = []string{"roles", "role_members", "role_permissions", "resource_role_permissons_index"}
+
+// ClusterInfo describes the cluster a snapshot was taken on.
+type ClusterInfo struct {
+	Name        string `json:"name"`
+	Partitioner string `json:"partitioner"`
+	Snitch      string `json:"snitch"`
+}
+
+// captureCluster takes the full schema of the cluster, its roles and
+// grants, and its name and partitioner from host, and returns them by
+// artifact name. Artifacts that could not be taken are left out and
+// returned with the reason in missing instead.
+func (p *Priam) captureCluster(host, timestamp string) (artifacts map[string][]byte, missing map[string]string) {
+	artifacts = make(map[string][]byte)
+	missing = make(map[string]string)
+
+	// full schema of all keyspaces
+	file, err := p.cassandra.FullSchemaBackup(host, timestamp)
+	if err == nil {
+		var r io.Reader
+		if r, err = p.agent.ReadFile(host, file); err == nil {
+			artifacts[fullSchemaName], err = ioutil.ReadAll(r)
+		}
+		p.agent.Run(host, fmt.Sprintf("rm -f %s", file))
+	}
+	if err != nil {
+		delete(artifacts, fullSchemaName)
+		missing[fullSchemaName] = err.Error()
+		glog.Warningf("unable to back up full schema: %v", err)
+	}
+
+	// roles and grants
+	auth, err := p.cassandra.AuthBackup(host)
+	if err != nil {
+		missing[authName] = err.Error()
+		glog.Warningf("unable to back up roles and permissions: %v", err)
+	} else {
+		artifacts[authName] = []byte(auth)
+	}
+
+	// cluster name and partitioner
+	info, err := p.cassandra.ClusterInfo(host)
+	if err != nil {
+		missing[clusterInfoName] = err.Error()
+		glog.Warningf("unable to back up cluster info: %v", err)
+	} else {
+		artifacts[clusterInfoName], _ = json.MarshalIndent(info, "", "  ")
+	}
+	return artifacts, missing
+}
+
+// clusterBackup uploads the cluster schema artifacts of the snapshot
+// and returns their keys by artifact name, along with the reason each
+// missing artifact could not be backed up. They are taken from the run
+// when several keyspaces are backed up together, else from host.
+func (p *Priam) clusterBackup(parent, timestamp, host string) (map[string]string, map[string]string) {
+	var cluster map[string][]byte
+	missing := make(map[string]string)
+	if p.run != nil {
+		cluster = p.run.cluster
+		for name, reason := range p.run.missing {
+			missing[name] = reason
+		}
+	} else {
+		cluster, missing = p.captureCluster(host, timestamp)
+	}
+	keys := make(map[string]string)
+	for name, data := range cluster {
+		key := p.artifactKey(parent, timestamp, name)
+		if _, err := p.putObject(key, bytes.NewReader(data), p.codec); err != nil {
+			missing[name] = err.Error()
+			glog.Warningf("unable to upload %s: %v", name, err)
+			continue
+		}
+		keys[name] = strings.TrimPrefix(key, "/")
+	}
+	return keys, missing
+}
+
+// artifactKey returns the key of a schema artifact of a snapshot.
+func (p *Priam) artifactKey(parent, timestamp, name string) string {
+	return fmt.Sprintf("/%s/%s/%s/%s/%s%s",
+		p.config.AwsBasePath, p.config.Keyspace,
+		parent, timestamp, name, p.codec.Extension)
+}
+
+// clusterKey returns the key of a cluster schema artifact of snapshot.
+func (p *Priam) clusterKey(snapshot, name string) (string, error) {
+	if m := p.hist.Manifest(snapshot); m != nil {
+		if key, ok := m.ClusterSchema[name]; ok {
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("snapshot %s has no %s", snapshot, name)
+}
+
+// checkCluster makes sure the cluster restored to uses the partitioner
+// snapshot was taken with, as data is placed by token.
+func (p *Priam) checkCluster(host, snapshot string) error {
+	backedUp, err := p.snapshotCluster(snapshot)
+	if err != nil || backedUp == nil {
+		return err
+	}
+	current, err := p.cassandra.ClusterInfo(host)
+	if err != nil {
+		return err
+	}
+	return compareCluster(snapshot, backedUp, current)
+}
+
+// snapshotCluster returns the cluster info backed up with snapshot, or
+// nil if snapshot has none.
+func (p *Priam) snapshotCluster(snapshot string) (*ClusterInfo, error) {
+	key, err := p.clusterKey(snapshot, clusterInfoName)
+	if err != nil {
+		return nil, nil
+	}
+	_, _, data, err := p.readKey(key, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading cluster info")
+	}
+	info := &ClusterInfo{}
+	if err = json.Unmarshal(data, info); err != nil {
+		return nil, errors.Wrapf(err, "error decoding cluster info %s", key)
+	}
+	return info, nil
+}
+
+// compareCluster returns an error if current uses another partitioner
+// than backedUp, the cluster snapshot was taken on.
+func compareCluster(snapshot string, backedUp, current *ClusterInfo) error {
+	if current.Partitioner != backedUp.Partitioner {
+		return fmt.Errorf("cluster uses partitioner %s, snapshot %s was taken with %s",
+			current.Partitioner, snapshot, backedUp.Partitioner)
+	}
+	if current.Name != backedUp.Name {
+		glog.Infof("restoring snapshot of cluster %s into cluster %s",
+			backedUp.Name, current.Name)
+	}
+	return nil
+}
+
+// restoreAuth recreates the roles and grants backed up with snapshot.
+// Existing roles are overwritten, others are left alone.
+func (p *Priam) restoreAuth(host, snapshot string) error {
+	key, err := p.clusterKey(snapshot, authName)
+	if err != nil {
+		return err
+	}
+	glog.Infof("restoring roles and permissions")
+	localTmpDir := fmt.Sprintf("%s/local", p.config.TempDir)
+	localFile, err := p.downloadKey(key, localTmpDir)
+	if err != nil {
+		return errors.Wrap(err, "error downloading roles")
+	}
+	return p.runCql(host, localFile)
+}
+
+// runCql copies a local file of cql statements to host and runs it with
+// cqlsh.
+func (p *Priam) runCql(host, localFile string) error {
+	localTmpDir := fmt.Sprintf("%s/local", p.config.TempDir)
+	remoteTmpDir := fmt.Sprintf("%s/remote", p.config.TempDir)
+	remoteFile := path.Join(remoteTmpDir, strings.TrimPrefix(localFile, localTmpDir))
+	if err := p.agent.UploadFile(host, localFile, path.Dir(remoteFile)); err != nil {
+		return errors.Wrap(err, "error uploading file")
+	}
+	cmd := fmt.Sprintf("cat %s | %s", remoteFile, p.config.CqlshPath)
+	if out, err := p.agent.Run(host, cmd); err != nil {
+		return errors.Wrapf(err, "error running %s: %s", remoteFile, out)
+	}
+	return nil
+}
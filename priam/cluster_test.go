@@ -0,0 +1,112 @@
+package priam
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAuthInserts(t *testing.T) {
+	output := `
+ [json]
+--------------------------------------------------------------------------------
+ {"role": "admin", "can_login": true, "is_superuser": true, "member_of": null, "salted_hash": "$2a$10$x"}
+ {"role": "o'brien", "can_login": true, "is_superuser": false, "member_of": null, "salted_hash": "$2a$10$y"}
+
+(2 rows)
+`
+	want := []string{
+		`INSERT INTO system_auth.roles JSON '{"role": "admin", "can_login": true, "is_superuser": true, "member_of": null, "salted_hash": "$2a$10$x"}';`,
+		`INSERT INTO system_auth.roles JSON '{"role": "o''brien", "can_login": true, "is_superuser": false, "member_of": null, "salted_hash": "$2a$10$y"}';`,
+	}
+	if got := authInserts("roles", []byte(output)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := authInserts("role_members", []byte("\n (0 rows)\n")); len(got) != 0 {
+		t.Errorf("got %v for no rows", got)
+	}
+}
+
+func TestParseClusterInfo(t *testing.T) {
+	output := `Cluster Information:
+	Name: Test Cluster
+	Snitch: org.apache.cassandra.locator.SimpleSnitch
+	DynamicEndPointSnitch: enabled
+	Partitioner: org.apache.cassandra.dht.Murmur3Partitioner
+	Schema versions:
+		86afa796-d883-3932-aa73-6b017cef0d19: [10.0.0.1]
+`
+	want := &ClusterInfo{
+		Name:        "Test Cluster",
+		Partitioner: "org.apache.cassandra.dht.Murmur3Partitioner",
+		Snitch:      "org.apache.cassandra.locator.SimpleSnitch",
+	}
+	got, err := parseClusterInfo([]byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if _, err := parseClusterInfo([]byte("nodetool: Failed to connect")); err == nil {
+		t.Errorf("no error for output without partitioner")
+	}
+}
+
+func TestCheckCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &Config{AwsBasePath: "base", Keyspace: "ks", StoragePath: dir}
+	p := &Priam{config: config, codec: codecs["gzip"], storage: NewLocal(config), hist: NewSnapshotHistory()}
+
+	// only the first snapshot has cluster info
+	backedUp := &ClusterInfo{Name: "prod", Partitioner: "org.apache.cassandra.dht.Murmur3Partitioner"}
+	data, err := json.Marshal(backedUp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := p.artifactKey("2026-03-01_000000", "2026-03-01_000000", clusterInfoName)
+	if _, err := p.putObject(key, bytes.NewReader(data), p.codec); err != nil {
+		t.Fatal(err)
+	}
+	p.hist.AddManifest(&Manifest{
+		Timestamp:     "2026-03-01_000000",
+		ClusterSchema: map[string]string{clusterInfoName: strings.TrimPrefix(key, "/")},
+	})
+	p.hist.AddManifest(&Manifest{Timestamp: "2026-03-02_000000"})
+
+	got, err := p.snapshotCluster("2026-03-01_000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, backedUp) {
+		t.Errorf("got %+v, want %+v", got, backedUp)
+	}
+	if got, err := p.snapshotCluster("2026-03-02_000000"); got != nil || err != nil {
+		t.Errorf("got %+v %v for snapshot without cluster info", got, err)
+	}
+
+	tests := []struct {
+		name    string
+		current ClusterInfo
+		err     bool
+	}{
+		{"same cluster", *backedUp, false},
+		{"other cluster", ClusterInfo{Name: "staging", Partitioner: backedUp.Partitioner}, false},
+		{"other partitioner", ClusterInfo{Name: "prod", Partitioner: "org.apache.cassandra.dht.RandomPartitioner"}, true},
+	}
+	for _, test := range tests {
+		current := test.current
+		err := compareCluster("2026-03-01_000000", backedUp, &current)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package priam
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commitlogsDir holds archived commitlog segments of every host, next to
+// the keyspace directories under the base path.
+const commitlogsDir = "commitlogs"
+
+// commitlogProperties is the cassandra config file controlling commitlog
+// archiving and replay.
+const commitlogProperties = "commitlog_archiving.properties"
+
+// restorePointFormat is the format of restore_point_in_time, in GMT.
+const restorePointFormat = "2006:01:02 15:04:05"
+
+// ArchiveCommitlog uploads the commitlog segment given by the commitlog
+// config parameter from this host to storage. It is meant to be run on
+// every cassandra node as archive_command in
+// commitlog_archiving.properties, with host set to the address of the
+// node.
+func (p *Priam) ArchiveCommitlog() error {
+	file := p.config.Commitlog
+	if file == "" {
+		return fmt.Errorf("please provide path of commitlog segment to archive (commitlog)")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "error opening commitlog %s", file)
+	}
+	defer f.Close()
+
+	key := p.commitlogKey(p.config.Host, path.Base(file))
+	glog.Infof("archive commitlog: %s", key)
+	if _, err = p.putObject(key, f, p.codec); err != nil {
+		return errors.Wrapf(err, "error archiving commitlog %s", file)
+	}
+	return nil
+}
+
+// commitlogKey returns the key of an archived commitlog segment.
+func (p *Priam) commitlogKey(host, name string) string {
+	return fmt.Sprintf("/%s/%s/%s/%s%s",
+		p.config.AwsBasePath, commitlogsDir, host, name, p.codec.Extension)
+}
+
+// stageCommitlogs copies the commitlog segments every host archived
+// since the data of a snapshot was taken at dataTime into the
+// commitlog-restore-dir on that host, and points
+// commitlog_archiving.properties at them with a restore point of until.
+// Cassandra replays them the next time it starts, limited to the restored
+// tables when started with the replay list of restartRequired.
+func (p *Priam) stageCommitlogs(hosts []string, dataTime string, until time.Time) error {
+	start, err := parseTimestamp(dataTime)
+	if err != nil {
+		return errors.Wrapf(err, "invalid snapshot timestamp %s", dataTime)
+	}
+
+	// find segments archived after the snapshot and started before until
+	prefix := fmt.Sprintf("%s/%s/", p.config.AwsBasePath, commitlogsDir)
+	objects, err := p.storage.List(prefix)
+	if err != nil {
+		return errors.Wrap(err, "error listing commitlogs")
+	}
+	segments := make(map[string][]string)
+	for _, obj := range objects {
+		parts := keyParts(obj.Key)
+		if len(parts) != 4 || obj.LastModified.Before(start) {
+			continue
+		}
+		if started, ok := segmentTime(sstableFile(obj.Key)); ok && started.After(until) {
+			continue
+		}
+		segments[parts[2]] = append(segments[parts[2]], obj.Key)
+	}
+
+	localTmpDir := fmt.Sprintf("%s/local", p.config.TempDir)
+	for _, host := range hosts {
+		keys := segments[host]
+		if len(keys) == 0 {
+			glog.Warningf("no commitlogs archived by %s since %s", host, dataTime)
+			continue
+		}
+		glog.Infof("staging %d commitlogs on %s", len(keys), host)
+		files, err := p.downloadKeys(keys, localTmpDir)
+		if err != nil {
+			return errors.Wrap(err, "error downloading commitlogs")
+		}
+		for _, key := range keys {
+			if err = p.agent.UploadFile(host, files[key], p.config.CommitlogDir); err != nil {
+				return errors.Wrapf(err, "error copying commitlogs to %s", host)
+			}
+		}
+		if err = p.restorePoint(host, until); err != nil {
+			return errors.Wrapf(err, "error setting restore point on %s", host)
+		}
+	}
+	return nil
+}
+
+// restartRequired is returned by a point in time restore once commitlogs
+// are staged, as the restore is not complete before cassandra has been
+// restarted on every host to replay them.
+type restartRequired struct {
+	replay []string
+	until  time.Time
+}
+
+func (e *restartRequired) Error() string {
+	return fmt.Sprintf("restart required: restart cassandra on every host with "+
+		"-Dcassandra.replayList=%s in JVM_EXTRA_OPTS to replay the staged commitlogs up to %s, "+
+		"then run clear-restore-point so later restarts do not replay them again",
+		strings.Join(e.replay, ","), e.until.Format(timestampFormat))
+}
+
+// restorePoint sets the restore settings in commitlog_archiving.properties
+// on host.
+func (p *Priam) restorePoint(host string, until time.Time) error {
+	return p.archiveSettings(host, map[string]string{
+		"restore_command":       "cp -f %from %to",
+		"restore_directories":   p.config.CommitlogDir,
+		"restore_point_in_time": until.UTC().Format(restorePointFormat),
+	})
+}
+
+// ClearRestorePoint removes the restore settings written by a point in
+// time restore from commitlog_archiving.properties on every host. It is
+// meant to be run once cassandra has replayed the staged commitlogs, as
+// every later start would replay them again.
+func (p *Priam) ClearRestorePoint() error {
+	hosts := p.cassandra.Hosts()
+	if len(hosts) == 0 {
+		return fmt.Errorf("did not find valid cassandra hosts")
+	}
+	for _, host := range hosts {
+		glog.Infof("clear restore point @ %s", host)
+		err := p.archiveSettings(host, map[string]string{
+			"restore_command":       "",
+			"restore_directories":   "",
+			"restore_point_in_time": "",
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error clearing restore point on %s", host)
+		}
+	}
+	return nil
+}
+
+// archiveSettings sets settings in commitlog_archiving.properties on
+// host, removing those set to an empty string and keeping all others.
+func (p *Priam) archiveSettings(host string, settings map[string]string) error {
+	remoteFile := path.Join(p.config.CassandraConf, commitlogProperties)
+	current, err := p.agent.Run(host, fmt.Sprintf("cat %s", remoteFile))
+	if err != nil {
+		glog.Warningf("no %s on %s, creating it", remoteFile, host)
+		current = nil
+	}
+
+	localDir := fmt.Sprintf("%s/local/%s", p.config.TempDir, host)
+	if err = os.MkdirAll(localDir, os.ModeDir|os.ModePerm); err != nil {
+		return errors.Wrapf(err, "error creating dir %s", localDir)
+	}
+	localFile := path.Join(localDir, commitlogProperties)
+	if err = ioutil.WriteFile(localFile, mergeSettings(current, settings), 0644); err != nil {
+		return errors.Wrapf(err, "error writing %s", localFile)
+	}
+	return p.agent.UploadFile(host, localFile, p.config.CassandraConf)
+}
+
+// mergeSettings returns the properties file current with settings set,
+// those set to an empty string removed and all other lines kept.
+func mergeSettings(current []byte, settings map[string]string) []byte {
+	var lines []string
+	for _, line := range strings.Split(string(current), "\n") {
+		name := strings.TrimSpace(strings.SplitN(line, "=", 2)[0])
+		if _, ok := settings[name]; !ok && line != "" {
+			lines = append(lines, line)
+		}
+	}
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if settings[name] != "" {
+			lines = append(lines, fmt.Sprintf("%s=%s", name, settings[name]))
+		}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// segmentTime returns a time no later than the start of a commitlog
+// segment such as CommitLog-7-1514764800000.log. Cassandra numbers
+// segments onwards from the time it started up, in milliseconds.
+func segmentTime(name string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, ".log")
+	ms, err := strconv.ParseInt(name[strings.LastIndex(name, "-")+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+// removeCommitlogs deletes archived commitlog segments no snapshot of any
+// keyspace can replay any more, which are those archived before the data
+// of the oldest snapshot was taken. The snapshots in removed no longer
+// count.
+func (p *Priam) removeCommitlogs(removed []string) error {
+	gone := make(map[string]bool)
+	for _, snapshot := range removed {
+		gone[snapshot] = true
+	}
+	oldest := ""
+	for _, snapshot := range p.hist.List() {
+		if t := p.hist.DataTime(snapshot); !gone[snapshot] && (oldest == "" || t < oldest) {
+			oldest = t
+		}
+	}
+
+	// commitlogs are shared by all keyspaces
+	keyspaces, err := p.storedKeyspaces()
+	if err != nil {
+		return err
+	}
+	for _, keyspace := range keyspaces {
+		if keyspace == p.config.Keyspace {
+			continue
+		}
+		other := p.forKeyspace(keyspace, "", nil)
+		if err = other.SnapshotHistory(); err != nil {
+			return errors.Wrapf(err, "error getting snapshot history of %s", keyspace)
+		}
+		for _, snapshot := range other.hist.List() {
+			if t := other.hist.DataTime(snapshot); oldest == "" || t < oldest {
+				oldest = t
+			}
+		}
+	}
+	if oldest == "" {
+		return nil
+	}
+	cutoff, err := parseTimestamp(oldest)
+	if err != nil {
+		return errors.Wrapf(err, "invalid snapshot timestamp %s", oldest)
+	}
+
+	prefix := fmt.Sprintf("%s/%s/", p.config.AwsBasePath, commitlogsDir)
+	objects, err := p.storage.List(prefix)
+	if err != nil {
+		return errors.Wrap(err, "error listing commitlogs")
+	}
+	var keys []string
+	for _, obj := range objects {
+		if len(keyParts(obj.Key)) == 4 && obj.LastModified.Before(cutoff) {
+			keys = append(keys, obj.Key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if p.config.DryRun {
+		fmt.Printf("would remove %d commitlogs archived before %s\n", len(keys), oldest)
+		return nil
+	}
+	fmt.Printf("removing %d commitlogs archived before %s\n", len(keys), oldest)
+	return p.deleteKeys(keys)
+}
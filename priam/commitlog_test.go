@@ -0,0 +1,170 @@
+package priam
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSegmentTime(t *testing.T) {
+	tests := []struct {
+		name string
+		want time.Time
+		ok   bool
+	}{
+		{"CommitLog-7-1514764800000.log", time.Unix(1514764800, 0), true},
+		{"CommitLog-6-1514764800123.log", time.Unix(1514764800, 123*int64(time.Millisecond)), true},
+		{"CommitLog-7-1514764800000", time.Unix(1514764800, 0), true},
+		{"CommitLog-7-x.log", time.Time{}, false},
+		{"commitlog_archiving.properties", time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, ok := segmentTime(test.name)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("%s: got %v %v, want %v %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestMergeSettings(t *testing.T) {
+	settings := map[string]string{
+		"restore_command":       "cp -f %from %to",
+		"restore_directories":   "/var/lib/cassandra/restore",
+		"restore_point_in_time": "2026:03:10 12:00:00",
+	}
+	cleared := map[string]string{
+		"restore_command":       "",
+		"restore_directories":   "",
+		"restore_point_in_time": "",
+	}
+	tests := []struct {
+		name     string
+		current  string
+		settings map[string]string
+		want     string
+	}{
+		{
+			name:     "new file",
+			settings: settings,
+			want: "restore_command=cp -f %from %to\n" +
+				"restore_directories=/var/lib/cassandra/restore\n" +
+				"restore_point_in_time=2026:03:10 12:00:00\n",
+		},
+		{
+			name:     "keeps other settings",
+			current:  "# archiving\narchive_command=/bin/archive %path\nrestore_point_in_time = 2026:03:01 00:00:00\n",
+			settings: settings,
+			want: "# archiving\narchive_command=/bin/archive %path\n" +
+				"restore_command=cp -f %from %to\n" +
+				"restore_directories=/var/lib/cassandra/restore\n" +
+				"restore_point_in_time=2026:03:10 12:00:00\n",
+		},
+		{
+			name: "clears settings",
+			current: "archive_command=/bin/archive %path\n" +
+				"restore_command=cp -f %from %to\n" +
+				"restore_directories=/var/lib/cassandra/restore\n" +
+				"restore_point_in_time=2026:03:10 12:00:00\n",
+			settings: cleared,
+			want:     "archive_command=/bin/archive %path\n",
+		},
+	}
+	for _, test := range tests {
+		got := string(mergeSettings([]byte(test.current), test.settings))
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRemoveCommitlogs(t *testing.T) {
+	tests := []struct {
+		name   string
+		other  bool
+		dryRun bool
+		want   []string
+	}{
+		{
+			name: "before oldest snapshot",
+			want: []string{"CommitLog-7-3.log"},
+		},
+		{
+			name:  "kept for other keyspace",
+			other: true,
+			want:  []string{"CommitLog-7-2.log", "CommitLog-7-3.log"},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+			want:   []string{"CommitLog-7-1.log", "CommitLog-7-2.log", "CommitLog-7-3.log"},
+		},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "priam")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		p := testStorage(t, dir)
+		p.config.DryRun = test.dryRun
+		if test.other {
+			key := "base/other/2026-03-03_000000/2026-03-03_000000/10.0.0.1/data/other/t-1/mc-1-big-Data.db"
+			if err := p.storage.Put(key, strings.NewReader("data"), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		archived := map[string]time.Time{
+			"CommitLog-7-1.log": time.Date(2026, 3, 2, 0, 0, 0, 0, time.Local),
+			"CommitLog-7-2.log": time.Date(2026, 3, 4, 0, 0, 0, 0, time.Local),
+			"CommitLog-7-3.log": time.Date(2026, 3, 6, 0, 0, 0, 0, time.Local),
+		}
+		for name, mtime := range archived {
+			key := "base/commitlogs/10.0.0.1/" + name
+			if err := p.storage.Put(key, strings.NewReader("segment"), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(p.storage.(*Local).file(key), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// removing the first full snapshot leaves the one of 2026-03-05
+		p.hist = testHistory()
+		if err := p.removeCommitlogs([]string{"2026-03-01_000000", "2026-03-02_000000"}); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		objects, err := p.storage.List("base/commitlogs/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var left []string
+		for _, obj := range objects {
+			left = append(left, sstableFile(obj.Key))
+		}
+		if !reflect.DeepEqual(left, test.want) {
+			t.Errorf("%s: left %v, want %v", test.name, left, test.want)
+		}
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	until := time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local)
+	p := &Priam{config: &Config{}}
+	err := p.eachKeyspace([]string{"ks1", "ks2"}, "2026-03-10_120000", nil, func(p *Priam) error {
+		return &restartRequired{replay: []string{p.config.Keyspace + ".t"}, until: until}
+	})
+	r, ok := err.(*restartRequired)
+	if !ok {
+		t.Fatalf("got error %v, want restart required", err)
+	}
+	if want := []string{"ks1.t", "ks2.t"}; !reflect.DeepEqual(r.replay, want) {
+		t.Errorf("got replay list %v, want %v", r.replay, want)
+	}
+	if !strings.Contains(err.Error(), "-Dcassandra.replayList=ks1.t,ks2.t") {
+		t.Errorf("error %q does not name the replay list", err)
+	}
+}
@@ -0,0 +1,158 @@
+package priam
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Metadata entries describing compression of an object.
+const (
+	metaCompression      = "priam-compression"
+	metaCompressionLevel = "priam-compression-level"
+)
+
+// Codec compresses backup objects before they are uploaded. Level 0
+// always selects the default level of the codec.
+type Codec struct {
+	Name      string
+	Extension string
+	writer    func(w io.Writer, level int) (io.WriteCloser, error)
+	reader    func(r io.Reader) (io.ReadCloser, error)
+}
+
+// codecs supported for backup objects, by name.
+var codecs = map[string]*Codec{
+	"gzip": {
+		Name:      "gzip",
+		Extension: ".gz",
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zstd": {
+		Name:      "zstd",
+		Extension: ".zst",
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				return zstd.NewWriter(w)
+			}
+			if level < 1 || level > 22 {
+				return nil, fmt.Errorf("zstd level must be between 1 and 22")
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+		},
+	},
+	"lz4": {
+		Name:      "lz4",
+		Extension: ".lz4",
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) {
+			zw := lz4.NewWriter(w)
+			if level == 0 {
+				return zw, nil
+			}
+			levels := []lz4.CompressionLevel{lz4.Level1, lz4.Level2,
+				lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6,
+				lz4.Level7, lz4.Level8, lz4.Level9}
+			if level < 1 || level > len(levels) {
+				return nil, fmt.Errorf("lz4 level must be between 1 and %d", len(levels))
+			}
+			if err := zw.Apply(lz4.CompressionLevelOption(levels[level-1])); err != nil {
+				return nil, err
+			}
+			return zw, nil
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(lz4.NewReader(r)), nil
+		},
+	},
+	"none": {
+		Name:      "none",
+		Extension: "",
+		writer: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(r), nil
+		},
+	},
+}
+
+// NewCodec returns the codec with given name.
+func NewCodec(name string) (*Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression '%s'", name)
+	}
+	return codec, nil
+}
+
+// codecForKey returns the codec an object was compressed with. It is
+// taken from object metadata, falling back to the key extension for
+// objects uploaded before the codec was recorded.
+func codecForKey(key string, meta map[string]string) (*Codec, error) {
+	if name, ok := meta[metaCompression]; ok {
+		return NewCodec(name)
+	}
+	for _, codec := range codecs {
+		if codec.Extension != "" && strings.HasSuffix(key, codec.Extension) {
+			return codec, nil
+		}
+	}
+	return codecs["none"], nil
+}
+
+// Writer returns a writer compressing into w at given level, along with
+// metadata recording the codec.
+func (c *Codec) Writer(w io.Writer, level int) (io.WriteCloser, map[string]string, error) {
+	cw, err := c.writer(w, level)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := map[string]string{
+		metaCompression:      c.Name,
+		metaCompressionLevel: strconv.Itoa(level),
+	}
+	return cw, meta, nil
+}
+
+// CheckLevel returns an error if the codec does not support level.
+func (c *Codec) CheckLevel(level int) error {
+	w, err := c.writer(ioutil.Discard, level)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Reader returns a reader decompressing r.
+func (c *Codec) Reader(r io.Reader) (io.ReadCloser, error) {
+	return c.reader(r)
+}
+
+// nopWriteCloser adds a no-op Close to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -9,26 +9,70 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"strings"
 )
 
 // Config holds priam configuration parameters.
 type Config struct {
+	AllKeyspaces       bool   `yaml:"all-keyspaces"`
 	AwsAccessKey       string `yaml:"aws-access-key"`
 	AwsBasePath        string `yaml:"aws-base-path"`
 	AwsBucket          string `yaml:"aws-bucket"`
+	AwsCACert          string `yaml:"aws-ca-cert"`
+	AwsEndpoint        string `yaml:"aws-endpoint"`
+	AwsExternalID      string `yaml:"aws-external-id"`
+	AwsInsecureTLS     bool   `yaml:"aws-insecure-tls"`
+	AwsPathStyle       bool   `yaml:"aws-path-style"`
+	AwsProfile         string `yaml:"aws-profile"`
 	AwsRegion          string `yaml:"aws-region"`
+	AwsRoleArn         string `yaml:"aws-role-arn"`
 	AwsSecretKey       string `yaml:"aws-secret-key"`
+	AwsSSE             string `yaml:"aws-sse"`
+	AwsSSECustomerKey  string `yaml:"aws-sse-customer-key"`
+	AwsSSEKMSKeyID     string `yaml:"aws-sse-kms-key-id"`
+	AwsStorageClass    string `yaml:"aws-storage-class"`
+	AwsTags            string `yaml:"aws-tags"`
 	CassandraClasspath string `yaml:"cassandra-classpath"`
 	CassandraConf      string `yaml:"cassandra-conf"`
+	Cascade            bool
+	Commitlog          string
+	CommitlogDir       string `yaml:"commitlog-restore-dir"`
+	Compression        string
+	CompressionLevel   int    `yaml:"compression-level"`
 	CqlshPath          string `yaml:"cqlsh-path"`
+	Dedup              bool
+	DownloadWorkers    int    `yaml:"download-parallelism"`
+	DryRun             bool   `yaml:"dry-run"`
+	EncryptionKey      string `yaml:"encryption-key"`
+	ExcludeTables      string `yaml:"exclude-tables"`
+	FileParallelism    int    `yaml:"file-parallelism"`
+	Format             string
 	Host               string
 	Incremental        bool
+	KeepDaily          int `yaml:"keep-daily"`
+	KeepLast           int `yaml:"keep-last"`
+	KeepWeekly         int `yaml:"keep-weekly"`
 	Keyspace           string
+	Keyspaces          string
+	Loader             string
+	MaxAge             string  `yaml:"max-age"`
+	MaxIncChain        int     `yaml:"max-incremental-chain"`
+	MaxIncRatio        float64 `yaml:"max-incremental-bytes-ratio"`
+	Mode               string
 	Nodetool           string
+	Parallelism        int
+	Tables             string
+	TargetKeyspace     string `yaml:"target-keyspace"`
 	TempDir            string `yaml:"temp-dir"`
 	PrivateKey         string `yaml:"private-key"`
+	RestoreAuth        bool   `yaml:"restore-auth"`
+	RestoreTime        string `yaml:"restore-time"`
+	Retries            int
 	Snapshot           string
 	Sstableloader      string
+	Storage            string
+	SystemKeyspaces    bool   `yaml:"system-keyspaces"`
+	StoragePath        string `yaml:"storage-path"`
 	User               string
 }
 
@@ -67,10 +111,20 @@ func DefaultConfig() (*Config, error) {
 		AwsRegion:          "us-east-1",
 		CassandraClasspath: "/usr/share/cassandra",
 		CassandraConf:      "/etc/cassandra",
+		CommitlogDir:       "/var/lib/cassandra/commitlog_restore",
+		Compression:        "gzip",
 		CqlshPath:          "/usr/local/bin/cqlsh",
+		DownloadWorkers:    4,
+		FileParallelism:    1,
+		Format:             "tree",
+		Loader:             "sstableloader",
+		Mode:               "replace",
 		Nodetool:           "/usr/bin/nodetool",
+		Parallelism:        1,
 		PrivateKey:         path.Join(usr.HomeDir, ".ssh", "id_rsa"),
+		Retries:            3,
 		Sstableloader:      "/usr/bin/sstableloader",
+		Storage:            "s3",
 		TempDir:            "/tmp/go-priam/restore",
 		User:               usr.Username,
 	}, nil
@@ -120,20 +174,63 @@ func (c *Config) parseFile(confFile string) error {
 // parseFlags from command line.
 func (c *Config) parseFlags() error {
 	flag.BoolVar(&c.Incremental, "incremental", c.Incremental, "take incremental backup")
+	flag.BoolVar(&c.AllKeyspaces, "all-keyspaces", c.AllKeyspaces, "work on all keyspaces")
 	flag.StringVar(&c.AwsAccessKey, "aws-access-key", c.AwsAccessKey, "AWS Access Key ID to access S3")
 	flag.StringVar(&c.AwsBasePath, "aws-base-path", c.AwsBasePath, "base path to copy/restore files from S3")
 	flag.StringVar(&c.AwsBucket, "aws-bucket", c.AwsBucket, "bucket name to store backups")
+	flag.StringVar(&c.AwsCACert, "aws-ca-cert", c.AwsCACert, "CA certificate to trust for S3 endpoint")
+	flag.StringVar(&c.AwsEndpoint, "aws-endpoint", c.AwsEndpoint, "custom endpoint url for S3 compatible services")
+	flag.StringVar(&c.AwsExternalID, "aws-external-id", c.AwsExternalID, "external id used when assuming aws-role-arn")
+	flag.BoolVar(&c.AwsInsecureTLS, "aws-insecure-tls", c.AwsInsecureTLS, "skip TLS certificate verification for S3 endpoint")
+	flag.BoolVar(&c.AwsPathStyle, "aws-path-style", c.AwsPathStyle, "use path style addressing for S3 buckets")
+	flag.StringVar(&c.AwsProfile, "aws-profile", c.AwsProfile, "profile in shared AWS credentials file")
 	flag.StringVar(&c.AwsRegion, "aws-region", c.AwsRegion, "region of s3 account")
+	flag.StringVar(&c.AwsRoleArn, "aws-role-arn", c.AwsRoleArn, "ARN of IAM role to assume for S3 access")
 	flag.StringVar(&c.AwsSecretKey, "aws-secret-key", c.AwsSecretKey, "AWS Secret Access key to access S3")
+	flag.StringVar(&c.AwsSSE, "aws-sse", c.AwsSSE, "server side encryption for uploads (s3, kms, customer)")
+	flag.StringVar(&c.AwsSSECustomerKey, "aws-sse-customer-key", c.AwsSSECustomerKey, "file with base64 encoded key for customer provided encryption")
+	flag.StringVar(&c.AwsSSEKMSKeyID, "aws-sse-kms-key-id", c.AwsSSEKMSKeyID, "KMS key id for kms server side encryption")
+	flag.StringVar(&c.AwsStorageClass, "aws-storage-class", c.AwsStorageClass, "S3 storage class for uploads")
+	flag.StringVar(&c.AwsTags, "aws-tags", c.AwsTags, "tags for uploads in the form key=value,key=value")
 	flag.StringVar(&c.CassandraClasspath, "cassandra-classpath", c.CassandraClasspath, "directory where cassandra classfiles are placed")
 	flag.StringVar(&c.CassandraConf, "cassandra-conf", c.CassandraConf, "directory where cassandra conf files are placed")
+	flag.BoolVar(&c.Cascade, "cascade", c.Cascade, "also delete incremental snapshots depending on the deleted one")
+	flag.StringVar(&c.Commitlog, "commitlog", c.Commitlog, "path of commitlog segment to archive")
+	flag.StringVar(&c.CommitlogDir, "commitlog-restore-dir", c.CommitlogDir, "directory on cassandra hosts to stage commitlogs for replay in")
+	flag.StringVar(&c.Compression, "compression", c.Compression, "compression for backup files (gzip, zstd, lz4, none)")
+	flag.IntVar(&c.CompressionLevel, "compression-level", c.CompressionLevel, "compression level, 0 picks the codec default")
 	flag.StringVar(&c.CqlshPath, "cqlsh-path", c.CqlshPath, "path to cqlsh")
+	flag.BoolVar(&c.Dedup, "dedup", c.Dedup, "store each distinct data file once, shared between backups")
+	flag.IntVar(&c.DownloadWorkers, "download-parallelism", c.DownloadWorkers, "number of files to download at once during restore")
+	flag.BoolVar(&c.DryRun, "dry-run", c.DryRun, "print what prune or delete would remove without removing it")
+	flag.StringVar(&c.EncryptionKey, "encryption-key", c.EncryptionKey, "file with base64 encoded master key for client side encryption")
+	flag.StringVar(&c.ExcludeTables, "exclude-tables", c.ExcludeTables, "comma separated globs of tables to leave out of backup or restore")
+	flag.IntVar(&c.FileParallelism, "file-parallelism", c.FileParallelism, "number of files per host to upload at once")
+	flag.StringVar(&c.Format, "format", c.Format, "history output format (tree, json, yaml, table)")
 	flag.StringVar(&c.Host, "host", c.Host, "ip address of any one of the cassandra hosts")
+	flag.IntVar(&c.KeepDaily, "keep-daily", c.KeepDaily, "keep the latest backup of each of this many days")
+	flag.IntVar(&c.KeepLast, "keep-last", c.KeepLast, "keep this many latest full backups and their incrementals")
+	flag.IntVar(&c.KeepWeekly, "keep-weekly", c.KeepWeekly, "keep the latest backup of each of this many weeks")
 	flag.StringVar(&c.Keyspace, "keyspace", c.Keyspace, "cassandra keyspace to backup")
+	flag.StringVar(&c.MaxAge, "max-age", c.MaxAge, "keep backups younger than this, e.g. 30d or 720h")
+	flag.StringVar(&c.Keyspaces, "keyspaces", c.Keyspaces, "comma separated list of keyspaces to work on")
+	flag.StringVar(&c.Loader, "loader", c.Loader, "how restore loads sstables (sstableloader, refresh)")
+	flag.IntVar(&c.MaxIncChain, "max-incremental-chain", c.MaxIncChain, "take a full backup once this many incrementals are chained")
+	flag.Float64Var(&c.MaxIncRatio, "max-incremental-bytes-ratio", c.MaxIncRatio, "take a full backup once incrementals exceed this ratio of the full backup size")
+	flag.StringVar(&c.Mode, "mode", c.Mode, "how restore treats existing data (replace, additive)")
 	flag.StringVar(&c.Nodetool, "nodetool-path", c.Nodetool, "path to nodetool on the cassandra host")
+	flag.IntVar(&c.Parallelism, "parallelism", c.Parallelism, "number of hosts to backup or restore at once")
 	flag.StringVar(&c.PrivateKey, "private-key", c.PrivateKey, "path to private key used for password less ssh")
+	flag.BoolVar(&c.RestoreAuth, "restore-auth", c.RestoreAuth, "recreate backed up roles and permissions when restoring")
+	flag.StringVar(&c.RestoreTime, "restore-time", c.RestoreTime, "replay commitlogs up to this time after restoring")
+	flag.IntVar(&c.Retries, "retries", c.Retries, "number of times to retry a failed download")
 	flag.StringVar(&c.Snapshot, "snapshot", c.Snapshot, "restore to this timestamp")
 	flag.StringVar(&c.Sstableloader, "sstableloader", c.Sstableloader, "path to sstableloader on cassandra hosts")
+	flag.StringVar(&c.Storage, "storage", c.Storage, "storage backend to keep backups in")
+	flag.BoolVar(&c.SystemKeyspaces, "system-keyspaces", c.SystemKeyspaces, "include system keyspaces in all-keyspaces")
+	flag.StringVar(&c.StoragePath, "storage-path", c.StoragePath, "directory to keep backups in for local storage")
+	flag.StringVar(&c.Tables, "tables", c.Tables, "comma separated globs of tables to backup or restore, all by default")
+	flag.StringVar(&c.TargetKeyspace, "target-keyspace", c.TargetKeyspace, "restore into this keyspace instead of the backed up one")
 	flag.StringVar(&c.TempDir, "temp-dir", c.TempDir, "temporary directory to download files to")
 	flag.StringVar(&c.User, "user", c.User, "usename for password less ssh to cassandra host")
 
@@ -143,13 +240,32 @@ func (c *Config) parseFlags() error {
 
 // validateConfig checks if all required parameters are provided.
 func (c *Config) validateConfig() error {
+	switch c.Storage {
+	case "local":
+		if c.StoragePath == "" {
+			return fmt.Errorf("please provide directory to keep backups in (storage-path)")
+		}
+	case "s3":
+		switch {
+		case c.AwsAccessKey == "" && c.AwsSecretKey != "":
+			return fmt.Errorf("please provide AWS Access Key ID (aws-access-key)")
+		case c.AwsSecretKey == "" && c.AwsAccessKey != "":
+			return fmt.Errorf("please provide AWS Secret Access key (aws-secret-key)")
+		case c.AwsExternalID != "" && c.AwsRoleArn == "":
+			return fmt.Errorf("external id requires a role to assume (aws-role-arn)")
+		case c.AwsSSE != "" && c.AwsSSE != "s3" && c.AwsSSE != "kms" && c.AwsSSE != "customer":
+			return fmt.Errorf("unknown server side encryption '%s' (aws-sse)", c.AwsSSE)
+		case c.AwsSSEKMSKeyID != "" && c.AwsSSE != "kms":
+			return fmt.Errorf("KMS key id requires kms server side encryption (aws-sse)")
+		case c.AwsStorageClass != "" && !validStorageClass(c.AwsStorageClass):
+			return fmt.Errorf("unknown storage class '%s' (aws-storage-class)", c.AwsStorageClass)
+		case c.AwsSSE == "customer" && c.AwsSSECustomerKey == "":
+			return fmt.Errorf("please provide file with customer encryption key (aws-sse-customer-key)")
+		case c.AwsBucket == "":
+			return fmt.Errorf("please provide AWS S3 bucket name (aws-bucket)")
+		}
+	}
 	switch {
-	case c.AwsAccessKey == "":
-		return fmt.Errorf("please provide AWS Access Key ID (aws-access-key)")
-	case c.AwsSecretKey == "":
-		return fmt.Errorf("please provide AWS Secret Access key (aws-secret-key)")
-	case c.AwsBucket == "":
-		return fmt.Errorf("please provide AWS S3 bucket name (aws-bucket)")
 	case c.PrivateKey == "":
 		return fmt.Errorf("path to private key for passwordless ssh to cassandra hosts (private-key)")
 	case c.Nodetool == "":
@@ -164,27 +280,161 @@ func (c *Config) validateConfig() error {
 		return fmt.Errorf("please provide username to use for passwordless ssh (user)")
 	case c.Sstableloader == "":
 		return fmt.Errorf("please provide path to sstableloader executable on cassandra host (sstableloader)")
+	case c.Parallelism < 1:
+		return fmt.Errorf("number of hosts to backup at once must be at least 1 (parallelism)")
+	case c.FileParallelism < 1:
+		return fmt.Errorf("number of files to upload at once must be at least 1 (file-parallelism)")
+	case c.FileParallelism > maxSessions:
+		return fmt.Errorf("number of files to upload at once can be at most %d, the sessions sshd allows per connection by default (file-parallelism)",
+			maxSessions)
+	case c.DownloadWorkers < 1:
+		return fmt.Errorf("number of files to download at once must be at least 1 (download-parallelism)")
+	case c.Retries < 0:
+		return fmt.Errorf("number of retries can not be negative (retries)")
+	case !validGlobs(splitList(c.Tables)) || !validGlobs(splitList(c.ExcludeTables)):
+		return fmt.Errorf("invalid table pattern (tables, exclude-tables)")
+	case c.TargetKeyspace != "" && c.TargetKeyspace != c.Keyspace && c.RestoreTime != "":
+		return fmt.Errorf("commitlogs can not be replayed into another keyspace (target-keyspace, restore-time)")
+	case (c.Tables != "" || c.ExcludeTables != "") && c.RestoreTime != "":
+		return fmt.Errorf("commitlogs can only be replayed into a whole keyspace (tables, exclude-tables, restore-time)")
+	case c.Loader != "sstableloader" && c.Loader != "refresh":
+		return fmt.Errorf("unknown loader '%s' (loader)", c.Loader)
+	case c.Mode != "replace" && c.Mode != "additive":
+		return fmt.Errorf("unknown restore mode '%s' (mode)", c.Mode)
+	case c.Mode == "additive" && c.RestoreTime != "":
+		return fmt.Errorf("commitlogs can only be replayed after replacing the keyspace (mode, restore-time)")
+	case c.MaxIncChain < 0 || c.MaxIncRatio < 0:
+		return fmt.Errorf("incremental limits can not be negative (max-incremental-chain, max-incremental-bytes-ratio)")
+	case c.KeepLast < 0 || c.KeepDaily < 0 || c.KeepWeekly < 0:
+		return fmt.Errorf("retention counts can not be negative (keep-last, keep-daily, keep-weekly)")
+	}
+
+	// check restore time before anything is dropped
+	if c.RestoreTime != "" {
+		if _, err := parseTimestamp(c.RestoreTime); err != nil {
+			return fmt.Errorf("invalid restore time %s: %v (restore-time)", c.RestoreTime, err)
+		}
+	}
+
+	// check compression before any snapshot is taken
+	codec, ok := codecs[c.Compression]
+	if !ok {
+		return fmt.Errorf("unknown compression '%s' (compression)", c.Compression)
+	}
+	if err := codec.CheckLevel(c.CompressionLevel); err != nil {
+		return fmt.Errorf("invalid compression level %d: %v (compression-level)",
+			c.CompressionLevel, err)
 	}
 	return nil
 }
 
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validGlobs returns true if all patterns are valid globs.
+func validGlobs(patterns []string) bool {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// validStorageClass returns true if class is an S3 storage class.
+func validStorageClass(class string) bool {
+	switch class {
+	case "STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA",
+		"INTELLIGENT_TIERING", "GLACIER", "GLACIER_IR", "DEEP_ARCHIVE":
+		return true
+	}
+	return false
+}
+
+// tableSelected returns true if table matches none of the exclude
+// patterns and one of the include patterns, or there are none.
+func tableSelected(table string, include, exclude []string) bool {
+	for _, pattern := range exclude {
+		if ok, _ := path.Match(pattern, table); ok {
+			return false
+		}
+	}
+	for _, pattern := range include {
+		if ok, _ := path.Match(pattern, table); ok {
+			return true
+		}
+	}
+	return len(include) == 0
+}
+
 // String returns config in json string representation
 func (c *Config) String() string {
 	str := fmt.Sprintf("\n{")
+	str = fmt.Sprintf("%s\n\t\"%s\": %t,", str, "all-keyspaces", c.AllKeyspaces)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-access-key", c.AwsAccessKey)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-base-path", c.AwsBasePath)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-bucket", c.AwsBucket)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-ca-cert", c.AwsCACert)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-endpoint", c.AwsEndpoint)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-external-id", c.AwsExternalID)
+	str = fmt.Sprintf("%s\n\t\"%s\": %t,", str, "aws-insecure-tls", c.AwsInsecureTLS)
+	str = fmt.Sprintf("%s\n\t\"%s\": %t,", str, "aws-path-style", c.AwsPathStyle)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-profile", c.AwsProfile)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-region", c.AwsRegion)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-role-arn", c.AwsRoleArn)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-secret-key", c.AwsSecretKey)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-sse", c.AwsSSE)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-sse-customer-key", c.AwsSSECustomerKey)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-sse-kms-key-id", c.AwsSSEKMSKeyID)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-storage-class", c.AwsStorageClass)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "aws-tags", c.AwsTags)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "cassandra-classpath", c.CassandraClasspath)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "cassandra-conf", c.CassandraConf)
+	str = fmt.Sprintf("%s\n\t\"%s\": %t,", str, "cascade", c.Cascade)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "commitlog", c.Commitlog)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "commitlog-restore-dir", c.CommitlogDir)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "compression", c.Compression)
+	str = fmt.Sprintf("%s\n\t\"%s\": %d,", str, "compression-level", c.CompressionLevel)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "cqlsh-path", c.CqlshPath)
+	str = fmt.Sprintf("%s\n\t\"%s\": %t,", str, "dedup", c.Dedup)
+	str = fmt.Sprintf("%s\n\t\"%s\": %d,", str, "download-parallelism", c.DownloadWorkers)
+	str = fmt.Sprintf("%s\n\t\"%s\": %t,", str, "dry-run", c.DryRun)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "encryption-key", c.EncryptionKey)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "exclude-tables", c.ExcludeTables)
+	str = fmt.Sprintf("%s\n\t\"%s\": %d,", str, "file-parallelism", c.FileParallelism)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "format", c.Format)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "host", c.Host)
+	str = fmt.Sprintf("%s\n\t\"%s\": %d,", str, "keep-daily", c.KeepDaily)
+	str = fmt.Sprintf("%s\n\t\"%s\": %d,", str, "keep-last", c.KeepLast)
+	str = fmt.Sprintf("%s\n\t\"%s\": %d,", str, "keep-weekly", c.KeepWeekly)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "keyspace", c.Keyspace)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "keyspaces", c.Keyspaces)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "loader", c.Loader)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "max-age", c.MaxAge)
+	str = fmt.Sprintf("%s\n\t\"%s\": %d,", str, "max-incremental-chain", c.MaxIncChain)
+	str = fmt.Sprintf("%s\n\t\"%s\": %g,", str, "max-incremental-bytes-ratio", c.MaxIncRatio)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "mode", c.Mode)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "nodetool", c.Nodetool)
+	str = fmt.Sprintf("%s\n\t\"%s\": %d,", str, "parallelism", c.Parallelism)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "private-key", c.PrivateKey)
+	str = fmt.Sprintf("%s\n\t\"%s\": %t,", str, "restore-auth", c.RestoreAuth)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "restore-time", c.RestoreTime)
+	str = fmt.Sprintf("%s\n\t\"%s\": %d,", str, "retries", c.Retries)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "snapshot", c.Snapshot)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "sstableloader", c.Sstableloader)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "storage", c.Storage)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "storage-path", c.StoragePath)
+	str = fmt.Sprintf("%s\n\t\"%s\": %t,", str, "system-keyspaces", c.SystemKeyspaces)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "tables", c.Tables)
+	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "target-keyspace", c.TargetKeyspace)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "temp-dir", c.TempDir)
 	str = fmt.Sprintf("%s\n\t\"%s\": \"%s\",", str, "user", c.User)
 	str = fmt.Sprintf("%s\n}\n", str[:len(str)-1])
@@ -0,0 +1,33 @@
+package priam
+
+import (
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		err    bool
+	}{
+		{"defaults", func(c *Config) {}, false},
+		{"no files at once", func(c *Config) { c.FileParallelism = 0 }, true},
+		{"files up to ssh sessions", func(c *Config) { c.FileParallelism = maxSessions }, false},
+		{"files over ssh sessions", func(c *Config) { c.FileParallelism = maxSessions + 1 }, true},
+		{"restore time", func(c *Config) { c.RestoreTime = "2026-03-10_120000" }, false},
+		{"invalid restore time", func(c *Config) { c.RestoreTime = "2026-03-10 12:00" }, true},
+	}
+	for _, test := range tests {
+		c, err := DefaultConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Host = "10.0.0.1"
+		c.Keyspace = "ks"
+		c.AwsBucket = "bucket"
+		test.change(c)
+		if err := c.validateConfig(); (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+		}
+	}
+}
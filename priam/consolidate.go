@@ -0,0 +1,181 @@
+package priam
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Consolidate builds a new full snapshot out of an incremental snapshot
+// and the snapshots it depends on. Objects are copied within storage,
+// server side where the backend supports it, and cassandra is never
+// touched.
+func (p *Priam) Consolidate() error {
+
+	snapshot := p.config.Snapshot
+	if snapshot == "" {
+		return fmt.Errorf("please provide timestamp of snapshot to consolidate (snapshot)")
+	}
+
+	// get snapshot history
+	if err := p.SnapshotHistory(); err != nil {
+		return errors.Wrap(err, "error getting snapshot history")
+	}
+	if !p.hist.Valid(snapshot) {
+		return fmt.Errorf("%s is not a valid snapshot", snapshot)
+	}
+	if p.hist.IsFull(snapshot) {
+		return fmt.Errorf("%s is already a full snapshot", snapshot)
+	}
+	chain, err := p.hist.Chain(snapshot)
+	if err != nil {
+		return err
+	}
+	keys, err := p.hist.Keys(snapshot)
+	if err != nil {
+		return errors.Wrap(err, "failed to get all keys")
+	}
+	schemaKey, err := p.hist.SchemaKey(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// generate new timestamp
+	timestamp := p.NewTimestamp()
+	snapshots := p.hist.List()
+	if snapshots[len(snapshots)-1] > timestamp {
+		return fmt.Errorf("new timestamp %s less than last", timestamp)
+	}
+	glog.Infof("consolidating %d snapshots up to %s into full snapshot %s",
+		len(chain), snapshot, timestamp)
+
+	// manifest entries of every snapshot in the chain, needed to record
+	// when the data of the new snapshot was taken
+	objects := make(map[string]*ManifestObject)
+	for _, s := range chain {
+		m := p.hist.Manifest(s)
+		if m == nil {
+			return fmt.Errorf("snapshot %s has no manifest, can not consolidate %s", s, snapshot)
+		}
+		for _, obj := range m.Objects {
+			objects[obj.Key] = obj
+		}
+	}
+	source := p.hist.Manifest(snapshot)
+
+	// a backup of only some tables stays one, so restoring it leaves the
+	// other tables alone
+	for _, s := range chain {
+		m := p.hist.Manifest(s)
+		if strings.Join(m.Tables, ",") != strings.Join(source.Tables, ",") ||
+			strings.Join(m.ExcludeTables, ",") != strings.Join(source.ExcludeTables, ",") {
+			return fmt.Errorf("snapshots %s and %s were taken with different table filters, can not consolidate",
+				s, snapshot)
+		}
+	}
+	manifest := &Manifest{
+		Keyspace:         p.config.Keyspace,
+		Timestamp:        timestamp,
+		DataTime:         p.hist.DataTime(snapshot),
+		CassandraVersion: source.CassandraVersion,
+		Tokens:           source.Tokens,
+		Tables:           source.Tables,
+		ExcludeTables:    source.ExcludeTables,
+	}
+
+	// copy schema
+	dst := p.rebaseKey(schemaKey, timestamp)
+	if err = p.copyKey(schemaKey, dst); err != nil {
+		return errors.Wrap(err, "error copying schema")
+	}
+	manifest.Schema = strings.TrimPrefix(dst, "/")
+
+	// copy cluster schema artifacts
+	manifest.ClusterSchemaErrors = source.ClusterSchemaErrors
+	if len(source.ClusterSchema) > 0 {
+		manifest.ClusterSchema = make(map[string]string)
+		for name, key := range source.ClusterSchema {
+			dst := p.rebaseKey(key, timestamp)
+			if err = p.copyKey(key, dst); err != nil {
+				return errors.Wrapf(err, "error copying %s", name)
+			}
+			manifest.ClusterSchema[name] = strings.TrimPrefix(dst, "/")
+		}
+	}
+
+	// a file kept in several snapshots of the chain is copied only once
+	sources := make(map[string]string)
+	for _, key := range keys {
+		sources[p.rebaseKey(key, timestamp)] = key
+	}
+	var dsts []string
+	for dst := range sources {
+		dsts = append(dsts, dst)
+	}
+
+	// copy data files
+	var mu sync.Mutex
+	workers := p.config.Parallelism * p.config.FileParallelism
+	err = parallel(workers, dsts, func(dst string) error {
+		src := sources[dst]
+		obj, ok := objects[src]
+
+		// deduplicated files stay in their blob
+		if !ok || obj.Blob == "" {
+			if err := p.copyKey(src, dst); err != nil {
+				return err
+			}
+		}
+		if ok {
+			copied := *obj
+			copied.Key = strings.TrimPrefix(dst, "/")
+			mu.Lock()
+			manifest.Objects = append(manifest.Objects, &copied)
+			mu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// write manifest once every object is copied
+	sort.Slice(manifest.Objects, func(i, j int) bool {
+		return manifest.Objects[i].Key < manifest.Objects[j].Key
+	})
+	if err = p.writeManifest(timestamp, manifest); err != nil {
+		return err
+	}
+	glog.Infof("copied %d objects into snapshot %s", len(dsts)+1+len(manifest.ClusterSchema), timestamp)
+	return nil
+}
+
+// rebaseKey returns key moved under a full snapshot with timestamp.
+func (p *Priam) rebaseKey(key, timestamp string) string {
+	parts := keyParts(key)
+	parts[2] = timestamp
+	parts[3] = timestamp
+	return "/" + strings.Join(parts, "/")
+}
+
+// copyKey copies the object under src to dst as stored, without
+// decrypting or decompressing it. Backends that can not copy objects
+// themselves have them downloaded and uploaded again.
+func (p *Priam) copyKey(src, dst string) error {
+	glog.Infof("copy key: %s", dst)
+	if c, ok := p.storage.(Copier); ok {
+		return c.Copy(src, dst)
+	}
+	r, meta, err := p.storage.Get(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err = p.storage.Put(dst, r, meta); err != nil {
+		return errors.Wrapf(err, "error copying key %s", src)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package priam
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestSnapshot stores a snapshot with a schema, the given data files
+// by name and a manifest describing them.
+func writeTestSnapshot(t *testing.T, p *Priam, parent, timestamp string, files map[string]string, tables []string) {
+	schemaKey := p.schemaKey(parent, timestamp)
+	if _, err := p.putObject(schemaKey, strings.NewReader("CREATE KEYSPACE ks;"), p.codec); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{
+		Keyspace:  p.config.Keyspace,
+		Timestamp: timestamp,
+		Tokens:    map[string][]string{"10.0.0.1": {"100"}},
+		Schema:    strings.TrimPrefix(schemaKey, "/"),
+		Tables:    tables,
+	}
+	if parent != timestamp {
+		m.Parent = parent
+	}
+	for name, data := range files {
+		key := fmt.Sprintf("/%s/%s/%s/%s/10.0.0.1/data/ks/t-1/%s%s",
+			p.config.AwsBasePath, p.config.Keyspace, parent, timestamp, name, p.codec.Extension)
+		obj, err := p.putObject(key, strings.NewReader(data), p.codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj.Host, obj.Table, obj.File = "10.0.0.1", "t", name
+		m.Objects = append(m.Objects, obj)
+	}
+	if err := p.writeManifest(parent, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebaseKey(t *testing.T) {
+	p := &Priam{}
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"base/ks/2026-03-01_000000/2026-03-02_000000/10.0.0.1/data/ks/t-1/mc-1-big-Data.db.gz",
+			"/base/ks/2026-03-10_000000/2026-03-10_000000/10.0.0.1/data/ks/t-1/mc-1-big-Data.db.gz"},
+		{"/base/ks/2026-03-01_000000/2026-03-01_000000/ks.schema.gz",
+			"/base/ks/2026-03-10_000000/2026-03-10_000000/ks.schema.gz"},
+	}
+	for _, test := range tests {
+		if got := p.rebaseKey(test.key, "2026-03-10_000000"); got != test.want {
+			t.Errorf("rebaseKey(%s) = %s, want %s", test.key, got, test.want)
+		}
+	}
+}
+
+func TestConsolidate(t *testing.T) {
+	full, inc, consolidated := "2026-03-01_000000", "2026-03-02_000000", "2026-03-10_000000"
+	tests := []struct {
+		name     string
+		snapshot string
+		tables   []string
+		manifest bool
+		err      bool
+	}{
+		{name: "consolidate", snapshot: inc, manifest: true},
+		{name: "no snapshot", err: true, manifest: true},
+		{name: "full snapshot", snapshot: full, err: true, manifest: true},
+		{name: "missing manifest", snapshot: inc, err: true},
+		{name: "different table filters", snapshot: inc, tables: []string{"t"}, manifest: true, err: true},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "priam")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		config := &Config{
+			AwsBasePath:     "base",
+			Keyspace:        "ks",
+			StoragePath:     dir,
+			Parallelism:     1,
+			FileParallelism: 2,
+			Snapshot:        test.snapshot,
+		}
+		p := &Priam{config: config, codec: codecs["gzip"], storage: NewLocal(config), timestamp: consolidated}
+		writeTestSnapshot(t, p, full, full, map[string]string{"mc-1-big-Data.db": "one"}, nil)
+		writeTestSnapshot(t, p, full, inc, map[string]string{"mc-2-big-Data.db": "two"}, test.tables)
+		if !test.manifest {
+			if err := p.storage.Delete(p.manifestKey(full, full)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = p.Consolidate()
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+		}
+		if err != nil {
+			continue
+		}
+
+		p.hist = nil
+		if err := p.SnapshotHistory(); err != nil {
+			t.Fatal(err)
+		}
+		if !p.hist.IsFull(consolidated) {
+			t.Errorf("%s: %s is not a full snapshot", test.name, consolidated)
+		}
+		if got := p.hist.DataTime(consolidated); got != inc {
+			t.Errorf("%s: data time %s, want %s", test.name, got, inc)
+		}
+		if got := p.hist.Latest(""); got != consolidated {
+			t.Errorf("%s: latest snapshot %s, want %s", test.name, got, consolidated)
+		}
+		keys, err := p.hist.Keys(consolidated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := make(map[string]string)
+		for _, key := range keys {
+			_, _, data, err := p.readKey(key, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[sstableFile(key)] = string(data)
+		}
+		want := map[string]string{"mc-1-big-Data.db": "one", "mc-2-big-Data.db": "two"}
+		if !reflect.DeepEqual(contents, want) {
+			t.Errorf("%s: consolidated %v, want %v", test.name, contents, want)
+		}
+	}
+}
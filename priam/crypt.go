@@ -0,0 +1,277 @@
+package priam
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Metadata entries describing client side encryption of an object.
+const (
+	metaEncryption = "priam-encryption"
+	metaKeyID      = "priam-key-id"
+	metaWrappedKey = "priam-wrapped-key"
+	metaNonce      = "priam-nonce"
+)
+
+// cryptAlgorithm identifies the encryption scheme in object metadata.
+const cryptAlgorithm = "aes-256-gcm-chunked"
+
+// cryptChunkSize is the amount of plaintext sealed in each chunk.
+const cryptChunkSize = 64 * 1024
+
+// Crypt provides client side envelope encryption of backup objects. Each
+// object is encrypted with a random data key using AES-256-GCM in chunks
+// and the data key is itself encrypted with the master key and stored in
+// object metadata, so the storage backend never sees plaintext.
+type Crypt struct {
+	master cipher.AEAD
+	keyID  string
+}
+
+// NewCrypt returns a Crypt using the master key in the encryption-key
+// file, or nil if client side encryption is not configured.
+func NewCrypt(config *Config) (*Crypt, error) {
+	if config.EncryptionKey == "" {
+		return nil, nil
+	}
+	key, err := readKeyFile(config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	master, err := newGCM(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating master cipher")
+	}
+	sum := sha256.Sum256(key)
+	return &Crypt{
+		master: master,
+		keyID:  hex.EncodeToString(sum[:8]),
+	}, nil
+}
+
+// readKeyFile reads a base64 encoded 256 bit key from file.
+func readKeyFile(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading key file %s", file)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decoding key file %s", file)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key in %s is %d bytes, expected 32", file, len(key))
+	}
+	return key, nil
+}
+
+// Encrypt returns a writer that encrypts everything written to it into w
+// with a fresh data key, along with the metadata needed to decrypt it.
+// The returned writer must be closed to write the final chunk.
+func (c *Crypt) Encrypt(w io.Writer) (io.WriteCloser, map[string]string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, errors.Wrap(err, "error generating data key")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, nil, errors.Wrap(err, "error generating nonce")
+	}
+
+	// wrap data key with master key
+	keyNonce := make([]byte, c.master.NonceSize())
+	if _, err = rand.Read(keyNonce); err != nil {
+		return nil, nil, errors.Wrap(err, "error generating nonce")
+	}
+	wrapped := c.master.Seal(keyNonce, keyNonce, dataKey, nil)
+
+	meta := map[string]string{
+		metaEncryption: cryptAlgorithm,
+		metaKeyID:      c.keyID,
+		metaWrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		metaNonce:      base64.StdEncoding.EncodeToString(nonce),
+	}
+	return &encryptWriter{w: w, aead: aead, nonce: nonce}, meta, nil
+}
+
+// Decrypt returns a reader that decrypts r using the data key recorded
+// in meta. Objects without encryption metadata are returned unchanged.
+func (c *Crypt) Decrypt(key string, r io.Reader, meta map[string]string) (io.Reader, error) {
+	algorithm, ok := meta[metaEncryption]
+	if !ok {
+		return r, nil
+	}
+	if algorithm != cryptAlgorithm {
+		return nil, fmt.Errorf("%s uses unknown encryption '%s'", key, algorithm)
+	}
+	if c == nil {
+		return nil, fmt.Errorf("%s is encrypted, please provide encryption key (encryption-key)", key)
+	}
+	if meta[metaKeyID] != c.keyID {
+		return nil, fmt.Errorf("%s was encrypted with key %s but encryption-key is %s",
+			key, meta[metaKeyID], c.keyID)
+	}
+
+	// unwrap data key
+	wrapped, err := base64.StdEncoding.DecodeString(meta[metaWrappedKey])
+	if err != nil || len(wrapped) < c.master.NonceSize() {
+		return nil, fmt.Errorf("%s has invalid wrapped data key", key)
+	}
+	n := c.master.NonceSize()
+	dataKey, err := c.master.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key of %s, wrong encryption key", key)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(meta[metaNonce])
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%s has invalid nonce", key)
+	}
+	return &decryptReader{
+		r:     bufio.NewReader(r),
+		aead:  aead,
+		nonce: nonce,
+		chunk: make([]byte, cryptChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// newGCM returns an AES-GCM cipher for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce derives the nonce of chunk i from the object nonce.
+func chunkNonce(nonce []byte, i uint64) []byte {
+	n := make([]byte, len(nonce))
+	copy(n, nonce)
+	ctr := binary.BigEndian.Uint64(n[len(n)-8:]) ^ i
+	binary.BigEndian.PutUint64(n[len(n)-8:], ctr)
+	return n
+}
+
+// chunkAD is the additional data of a chunk. It marks the last chunk so
+// that a truncated stream fails to decrypt.
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptWriter seals plaintext in chunks of cryptChunkSize.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// only seal a full chunk once more data arrives, the last
+		// chunk is sealed by Close
+		if len(e.buf) == cryptChunkSize {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		m := cryptChunkSize - len(e.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		e.buf = append(e.buf, p[:m]...)
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// Close seals the final chunk.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	out := e.aead.Seal(nil, chunkNonce(e.nonce, e.counter), e.buf, chunkAD(final))
+	if _, err := e.w.Write(out); err != nil {
+		return err
+	}
+	e.counter++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// decryptReader opens chunks written by encryptWriter.
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	chunk   []byte
+	buf     []byte
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	final := false
+	switch err {
+	case nil:
+		if _, err = d.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		final = true
+	case io.EOF:
+		return fmt.Errorf("encrypted stream is truncated")
+	default:
+		return err
+	}
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.nonce, d.counter), d.chunk[:n], chunkAD(final))
+	if err != nil {
+		return fmt.Errorf("error decrypting chunk %d, data is corrupt", d.counter)
+	}
+	d.counter++
+	d.buf = plain
+	d.done = final
+	return nil
+}
@@ -0,0 +1,111 @@
+package priam
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testCrypt returns a Crypt with a random master key.
+func testCrypt(t *testing.T, dir, name string) *Crypt {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCrypt(&Config{EncryptionKey: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// encrypt returns data encrypted by c along with its metadata.
+func encrypt(t *testing.T, c *Crypt, data []byte) ([]byte, map[string]string) {
+	var buf bytes.Buffer
+	w, meta, err := c.Encrypt(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), meta
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := testCrypt(t, dir, "key")
+
+	for _, size := range []int{0, 1, cryptChunkSize - 1, cryptChunkSize, 3*cryptChunkSize + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+		encrypted, meta := encrypt(t, c, data)
+		if size >= 16 && bytes.Contains(encrypted, data) {
+			t.Errorf("size %d: plaintext found in encrypted data", size)
+		}
+		r, err := c.Decrypt("key", bytes.NewReader(encrypted), meta)
+		if err != nil {
+			t.Errorf("size %d: %v", size, err)
+			continue
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("size %d: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestCryptFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := testCrypt(t, dir, "key")
+	data := make([]byte, 2*cryptChunkSize)
+	rand.Read(data)
+	encrypted, meta := encrypt(t, c, data)
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)/2] ^= 1
+	truncated := encrypted[:len(encrypted)-1]
+
+	tests := []struct {
+		name      string
+		crypt     *Crypt
+		encrypted []byte
+	}{
+		{"wrong key", testCrypt(t, dir, "other"), encrypted},
+		{"no key", nil, encrypted},
+		{"tampered", c, tampered},
+		{"truncated", c, truncated},
+	}
+	for _, test := range tests {
+		r, err := test.crypt.Decrypt("key", bytes.NewReader(test.encrypted), meta)
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+		}
+		if err == nil {
+			t.Errorf("%s: decrypt did not fail", test.name)
+		}
+	}
+}
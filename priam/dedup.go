@@ -0,0 +1,175 @@
+package priam
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blobsDir holds the data files shared by snapshots taken with dedup,
+// stored once per content under the keyspace prefix.
+const blobsDir = "blobs"
+
+// pendingDir holds a marker for every backup taken with dedup that is in
+// progress, stored under the keyspace prefix.
+const pendingDir = "pending"
+
+// blobGracePeriod protects blobs uploaded by a backup that has not yet
+// written the manifest referring to them. Markers of backups in progress
+// older than this are left behind by failed backups and ignored.
+const blobGracePeriod = 24 * time.Hour
+
+// blobKey returns the key of the shared blob holding a data file with
+// the given sha256 checksum. Blobs encrypted with different master keys
+// or compressed with different codecs are kept apart.
+func (p *Priam) blobKey(sum string) string {
+	name := sum
+	if p.crypt != nil {
+		name = fmt.Sprintf("%s-%s", sum, p.crypt.keyID)
+	}
+	return fmt.Sprintf("/%s/%s/%s/%s%s",
+		p.config.AwsBasePath, p.config.Keyspace, blobsDir,
+		name, p.codec.Extension)
+}
+
+// uploadBlob backs up a data file on host as a shared blob. The file is
+// checksummed on the host first and only uploaded if no blob with the
+// same contents exists yet. The returned manifest entry refers to key
+// and records the blob holding its contents.
+func (p *Priam) uploadBlob(host, file, key string) (*ManifestObject, error) {
+	size, sum, err := p.remoteChecksum(host, file)
+	if err != nil {
+		return nil, err
+	}
+	return p.storeBlob(key, path.Base(file), size, sum, func(blob string) (*ManifestObject, error) {
+		return p.uploadFile(host, file, blob)
+	})
+}
+
+// storeBlob returns the manifest entry of key for a file with the given
+// size and checksum, stored in the blob for that checksum. If there is no
+// such blob yet, upload stores the file as one.
+func (p *Priam) storeBlob(key, file string, size int64, sum string,
+	upload func(blob string) (*ManifestObject, error)) (*ManifestObject, error) {
+	blob := p.blobKey(sum)
+
+	// reuse existing blob, which prune keeps while this backup is marked
+	// in progress
+	if info, err := p.storage.Stat(blob); err == nil {
+		glog.Infof("reuse blob for key: %s", key)
+		return &ManifestObject{
+			Key:            strings.TrimPrefix(key, "/"),
+			Blob:           strings.TrimPrefix(blob, "/"),
+			File:           file,
+			Size:           size,
+			CompressedSize: info.Size,
+			Sha256:         sum,
+		}, nil
+	}
+
+	obj, err := upload(blob)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Sha256 != sum {
+		// never leave a blob that does not hold what its key claims for
+		// later backups to reuse
+		if err := p.storage.Delete(blob); err != nil {
+			glog.Errorf("unable to remove blob %s not matching its checksum: %v", blob, err)
+		}
+		return nil, fmt.Errorf("file of %s changed during upload", key)
+	}
+	obj.Blob = obj.Key
+	obj.Key = strings.TrimPrefix(key, "/")
+	return obj, nil
+}
+
+// pendingKey returns the key of the marker of a backup in progress.
+func (p *Priam) pendingKey(timestamp string) string {
+	return fmt.Sprintf("/%s/%s/%s/%s",
+		p.config.AwsBasePath, p.config.Keyspace, pendingDir, timestamp)
+}
+
+// remoteChecksum returns size and sha256 checksum of file on host.
+func (p *Priam) remoteChecksum(host, file string) (int64, string, error) {
+	cmd := fmt.Sprintf("stat -c %%s %s && sha256sum %s", file, file)
+	out, err := p.agent.Run(host, cmd)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "error checksumming %s:%s: %s", host, file, out)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return 0, "", fmt.Errorf("unexpected checksum of %s:%s: %s", host, file, out)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "error parsing size of %s:%s", host, file)
+	}
+	return size, fields[1], nil
+}
+
+// removeBlobs deletes blobs no longer referenced by the manifest of any
+// snapshot other than those removed. Blobs younger than blobGracePeriod
+// are left alone, and all of them while a backup is in progress as it
+// may reuse any blob.
+func (p *Priam) removeBlobs(removed []string) error {
+	gone := make(map[string]bool)
+	for _, snapshot := range removed {
+		gone[snapshot] = true
+	}
+	referenced := make(map[string]bool)
+	for _, snapshot := range p.hist.List() {
+		m := p.hist.Manifest(snapshot)
+		if gone[snapshot] || m == nil {
+			continue
+		}
+		for _, obj := range m.Objects {
+			if obj.Blob != "" {
+				referenced[obj.Blob] = true
+			}
+		}
+	}
+
+	prefix := fmt.Sprintf("%s/%s/%s/", p.config.AwsBasePath, p.config.Keyspace, blobsDir)
+	objects, err := p.storage.List(prefix)
+	if err != nil {
+		return errors.Wrap(err, "error listing blobs")
+	}
+	cutoff := time.Now().Add(-blobGracePeriod)
+	var keys []string
+	for _, obj := range objects {
+		if !referenced[obj.Key] && obj.LastModified.Before(cutoff) {
+			keys = append(keys, obj.Key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// checked last, so a backup starting meanwhile is seen
+	pending, err := p.storage.List(fmt.Sprintf("%s/%s/%s/",
+		p.config.AwsBasePath, p.config.Keyspace, pendingDir))
+	if err != nil {
+		return errors.Wrap(err, "error listing backups in progress")
+	}
+	var stale []string
+	for _, obj := range pending {
+		if !obj.LastModified.Before(cutoff) {
+			fmt.Printf("backup %s in progress, keeping %d unreferenced blobs\n",
+				path.Base(obj.Key), len(keys))
+			return nil
+		}
+		stale = append(stale, obj.Key)
+	}
+
+	if p.config.DryRun {
+		fmt.Printf("would remove %d unreferenced blobs\n", len(keys))
+		return nil
+	}
+	fmt.Printf("removing %d unreferenced blobs\n", len(keys))
+	return p.deleteKeys(append(keys, stale...))
+}
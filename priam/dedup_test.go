@@ -0,0 +1,152 @@
+package priam
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &Config{AwsBasePath: "base", Keyspace: "ks", StoragePath: dir}
+	p := &Priam{config: config, codec: codecs["gzip"], storage: NewLocal(config)}
+
+	data := "sstable contents"
+	h := sha256.Sum256([]byte(data))
+	sum := hex.EncodeToString(h[:])
+	blob := strings.TrimPrefix(p.blobKey(sum), "/")
+	tests := []struct {
+		name     string
+		key      string
+		stored   string
+		uploaded bool
+		err      bool
+	}{
+		{name: "changed during upload", key: "base/ks/a/a/10.0.0.1/t-1/mc-1-big-Data.db.gz", stored: "changed", uploaded: true, err: true},
+		{name: "new blob", key: "base/ks/b/b/10.0.0.1/t-1/mc-1-big-Data.db.gz", stored: data, uploaded: true},
+		{name: "existing blob", key: "base/ks/c/c/10.0.0.1/t-1/mc-1-big-Data.db.gz", stored: data},
+	}
+	for _, test := range tests {
+		uploaded := false
+		obj, err := p.storeBlob(test.key, "mc-1-big-Data.db", int64(len(data)), sum,
+			func(key string) (*ManifestObject, error) {
+				uploaded = true
+				return p.putObject(key, strings.NewReader(test.stored), p.codec)
+			})
+		if uploaded != test.uploaded {
+			t.Errorf("%s: uploaded %v, want %v", test.name, uploaded, test.uploaded)
+		}
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+		}
+		if err != nil {
+			if _, err := p.storage.Stat(blob); err == nil {
+				t.Errorf("%s: blob not matching its checksum was left behind", test.name)
+			}
+			continue
+		}
+		if obj.Key != test.key || obj.Blob != blob || obj.Sha256 != sum || obj.Size != int64(len(data)) {
+			t.Errorf("%s: got %+v", test.name, obj)
+		}
+		_, got, _, err := p.readKey(blob, false)
+		if err != nil || got != sum {
+			t.Errorf("%s: blob holds checksum %s, want %s (%v)", test.name, got, sum, err)
+		}
+	}
+}
+
+func TestRemoveBlobs(t *testing.T) {
+	old := time.Now().Add(-2 * blobGracePeriod)
+	tests := []struct {
+		name    string
+		pending string // age of a backup in progress, if any
+		dryRun  bool
+		keep    []string
+	}{
+		{
+			name: "unreferenced",
+			keep: []string{"base/ks/blobs/fresh", "base/ks/blobs/kept"},
+		},
+		{
+			name:    "backup in progress",
+			pending: "fresh",
+			keep:    []string{"base/ks/blobs/fresh", "base/ks/blobs/kept", "base/ks/blobs/removed", "base/ks/blobs/unreferenced", "base/ks/pending/2026-03-10_000000"},
+		},
+		{
+			name:    "failed backup",
+			pending: "old",
+			keep:    []string{"base/ks/blobs/fresh", "base/ks/blobs/kept"},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+			keep:   []string{"base/ks/blobs/fresh", "base/ks/blobs/kept", "base/ks/blobs/removed", "base/ks/blobs/unreferenced"},
+		},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "priam")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		config := &Config{AwsBasePath: "base", Keyspace: "ks", StoragePath: dir, DownloadWorkers: 2, DryRun: test.dryRun}
+		p := &Priam{config: config, storage: NewLocal(config), hist: NewSnapshotHistory()}
+
+		// a kept and a removed snapshot, each referring to a blob
+		for _, name := range []string{"kept", "removed"} {
+			p.hist.AddManifest(&Manifest{
+				Timestamp: name,
+				Objects:   []*ManifestObject{{Key: "base/ks/" + name + "/" + name + "/f", Blob: "base/ks/blobs/" + name}},
+			})
+			p.hist.Add("base/ks/"+name+"/"+name+"/ks.schema", 1)
+		}
+		ages := map[string]time.Time{
+			"base/ks/blobs/kept":         old,
+			"base/ks/blobs/removed":      old,
+			"base/ks/blobs/unreferenced": old,
+			"base/ks/blobs/fresh":        time.Now(),
+		}
+		switch test.pending {
+		case "fresh":
+			ages["base/ks/pending/2026-03-10_000000"] = time.Now()
+		case "old":
+			ages["base/ks/pending/2026-03-10_000000"] = old
+		}
+		for key, age := range ages {
+			if err := p.storage.Put(key, strings.NewReader(""), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(filepath.Join(dir, key), age, age); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := p.removeBlobs([]string{"removed"}); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		objects, err := p.storage.List("base/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keep []string
+		for _, obj := range objects {
+			keep = append(keep, obj.Key)
+		}
+		sort.Strings(keep)
+		if !reflect.DeepEqual(keep, test.keep) {
+			t.Errorf("%s: kept %v, want %v", test.name, keep, test.keep)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package priam
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// Delete removes a single snapshot from storage. Incremental snapshots
+// that depend on it are removed too if cascade is set, otherwise the
+// snapshot is left alone.
+func (p *Priam) Delete() error {
+
+	snapshot := p.config.Snapshot
+	if snapshot == "" {
+		return fmt.Errorf("please provide timestamp of snapshot to delete (snapshot)")
+	}
+
+	// get snapshot history
+	if err := p.SnapshotHistory(); err != nil {
+		return errors.Wrap(err, "error getting snapshot history")
+	}
+	if !p.hist.Valid(snapshot) {
+		return fmt.Errorf("%s is not a valid snapshot", snapshot)
+	}
+
+	// refuse to break incremental chains unless asked to
+	dependents := p.hist.Descendants(snapshot)
+	if len(dependents) > 0 && !p.config.Cascade {
+		return fmt.Errorf("snapshots %s depend on %s, use -cascade to delete them too",
+			strings.Join(dependents, ", "), snapshot)
+	}
+
+	// delete newest first so an interrupted delete never leaves an
+	// incremental snapshot without its parent
+	var remove []string
+	for i := len(dependents) - 1; i >= 0; i-- {
+		remove = append(remove, dependents[i])
+	}
+	return p.removeSnapshots(append(remove, snapshot))
+}
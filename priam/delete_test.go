@@ -0,0 +1,85 @@
+package priam
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDelete(t *testing.T) {
+	all := []string{"2026-03-01_000000", "2026-03-02_000000", "2026-03-05_000000",
+		"2026-03-06_000000", "2026-03-07_000000", "2026-03-09_000000"}
+	tests := []struct {
+		name     string
+		snapshot string
+		cascade  bool
+		dryRun   bool
+		keep     []string
+		err      bool
+	}{
+		{
+			name: "no snapshot",
+			keep: all,
+			err:  true,
+		},
+		{
+			name:     "unknown snapshot",
+			snapshot: "2026-03-03_000000",
+			keep:     all,
+			err:      true,
+		},
+		{
+			name:     "dependents without cascade",
+			snapshot: "2026-03-05_000000",
+			keep:     all,
+			err:      true,
+		},
+		{
+			name:     "incremental without dependents",
+			snapshot: "2026-03-07_000000",
+			keep:     []string{"2026-03-01_000000", "2026-03-02_000000", "2026-03-05_000000", "2026-03-06_000000", "2026-03-09_000000"},
+		},
+		{
+			name:     "full without dependents",
+			snapshot: "2026-03-09_000000",
+			keep:     []string{"2026-03-01_000000", "2026-03-02_000000", "2026-03-05_000000", "2026-03-06_000000", "2026-03-07_000000"},
+		},
+		{
+			name:     "cascade",
+			snapshot: "2026-03-05_000000",
+			cascade:  true,
+			keep:     []string{"2026-03-01_000000", "2026-03-02_000000", "2026-03-09_000000"},
+		},
+		{
+			name:     "cascade from incremental",
+			snapshot: "2026-03-06_000000",
+			cascade:  true,
+			keep:     []string{"2026-03-01_000000", "2026-03-02_000000", "2026-03-05_000000", "2026-03-09_000000"},
+		},
+		{
+			name:     "dry run",
+			snapshot: "2026-03-05_000000",
+			cascade:  true,
+			dryRun:   true,
+			keep:     all,
+		},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "priam")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		p := testStorage(t, dir)
+		p.config.Snapshot = test.snapshot
+		p.config.Cascade = test.cascade
+		p.config.DryRun = test.dryRun
+		if err := p.Delete(); (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+		}
+		if kept := storedSnapshots(t, p); !reflect.DeepEqual(kept, test.keep) {
+			t.Errorf("%s: kept %v, want %v", test.name, kept, test.keep)
+		}
+	}
+}
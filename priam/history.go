@@ -2,36 +2,123 @@ package priam
 
 import (
 	"fmt"
+	"path"
 	"sort"
 	"strings"
 )
 
-// SnapshotHistory provides the history of all snapshots in S3 for a keyspace.
-// parent is set only for incremental backups.
+// SnapshotHistory provides the history of all snapshots in storage for a
+// keyspace.
+// Snapshots form a forest of chains: full snapshots are roots and parent
+// is set only for incremental backups, pointing at the snapshot they
+// were taken on top of.
+// Snapshots with a manifest are described by it, others by their keys.
 type SnapshotHistory struct {
-	parent map[string]string   // parent of a snapshot if incremental
-	keys   map[string][]string // list of keys for given snapshot
+	parent    map[string]string    // parent of a snapshot if incremental
+	keys      map[string][]string  // list of keys for given snapshot
+	size      map[string]int64     // total bytes stored for given snapshot
+	manifest  map[string]string    // key of manifest for given snapshot
+	manifests map[string]*Manifest // manifest for given snapshot
+	blobs     map[string]string    // shared blob holding a deduplicated key
 }
 
 // NewSnapshotHistory initializes new snapshot history.
 func NewSnapshotHistory() *SnapshotHistory {
 	return &SnapshotHistory{
-		parent: make(map[string]string),
-		keys:   make(map[string][]string),
+		parent:    make(map[string]string),
+		keys:      make(map[string][]string),
+		size:      make(map[string]int64),
+		manifest:  make(map[string]string),
+		manifests: make(map[string]*Manifest),
+		blobs:     make(map[string]string),
 	}
 }
 
-// Add key to snapshot history.
-func (h *SnapshotHistory) Add(key string) {
-	parts := strings.Split(key, "/")
+// Add key of given size to snapshot history.
+func (h *SnapshotHistory) Add(key string, size int64) {
+	parts := keyParts(key)
+	if len(parts) < 5 || parts[2] == blobsDir {
+		return
+	}
 	parent := parts[2]
 	timestamp := parts[3]
 	if parent != timestamp {
 		h.parent[timestamp] = parent
 	}
+	h.size[timestamp] += size
+	if len(parts) == 5 && parts[4] == manifestName {
+		h.manifest[timestamp] = key
+		return
+	}
 	h.keys[timestamp] = append(h.keys[timestamp], key)
 }
 
+// AddManifest records the manifest of a snapshot.
+func (h *SnapshotHistory) AddManifest(m *Manifest) {
+	h.manifests[m.Timestamp] = m
+	if m.Parent != "" {
+		h.parent[m.Timestamp] = m.Parent
+	}
+	for _, obj := range m.Objects {
+		if obj.Blob != "" {
+			h.blobs[obj.Key] = obj.Blob
+			h.size[m.Timestamp] += obj.CompressedSize
+		}
+	}
+}
+
+// StorageKey returns the key the contents of key are stored under, which
+// is a shared blob for data files backed up with dedup.
+func (h *SnapshotHistory) StorageKey(key string) string {
+	if h == nil {
+		return key
+	}
+	if blob, ok := h.blobs[strings.TrimPrefix(key, "/")]; ok {
+		return blob
+	}
+	return key
+}
+
+// ManifestKeys returns keys of all manifests ordered by timestamp.
+func (h *SnapshotHistory) ManifestKeys() []string {
+	var keys []string
+	for _, timestamp := range h.List() {
+		if key, ok := h.manifest[timestamp]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Manifest returns the manifest of a snapshot, or nil if it has none.
+func (h *SnapshotHistory) Manifest(snapshot string) *Manifest {
+	return h.manifests[snapshot]
+}
+
+// keyParts splits a key into its path segments: base path, keyspace,
+// parent, timestamp and, for data files, host followed by the path of
+// the file on that host.
+func keyParts(key string) []string {
+	return strings.Split(strings.TrimPrefix(key, "/"), "/")
+}
+
+// isDataKey returns true if key holds a cassandra data file, as opposed
+// to the schema or manifest of a snapshot.
+func isDataKey(key string) bool {
+	return len(keyParts(key)) > 5
+}
+
+// isMetadataKey returns true if key holds the manifest, the schema or a
+// cluster schema artifact of a snapshot, going by its file name.
+func isMetadataKey(key string) bool {
+	switch name := sstableFile(key); name {
+	case manifestName, fullSchemaName, authName, clusterInfoName:
+		return true
+	default:
+		return strings.HasSuffix(name, ".schema")
+	}
+}
+
 // List returns a ordered list of timestamps.
 func (h *SnapshotHistory) List() []string {
 	var timestamps []string
@@ -42,22 +129,158 @@ func (h *SnapshotHistory) List() []string {
 	return timestamps
 }
 
-// Keys returns all keys for a given snapshot including keys for
+// Keys returns all data keys for a given snapshot including keys for
 // parent snapshots if this is an incremental backup.
 func (h *SnapshotHistory) Keys(snapshot string) ([]string, error) {
+	chain, err := h.Chain(snapshot)
+	if err != nil {
+		return nil, err
+	}
 	var keys []string
+	for _, s := range chain {
+		if m, ok := h.manifests[s]; ok {
+			for _, obj := range m.Objects {
+				keys = append(keys, obj.Key)
+			}
+			continue
+		}
+		for _, key := range h.keys[s] {
+			if isDataKey(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Chain returns the snapshots needed to restore snapshot, starting with
+// the full snapshot at the root of its chain and ending with snapshot.
+func (h *SnapshotHistory) Chain(snapshot string) ([]string, error) {
+	var chain []string
 	for {
-		k, ok := h.keys[snapshot]
-		if !ok {
+		if !h.Valid(snapshot) {
 			return nil, fmt.Errorf("did not find snapshot %s", snapshot)
 		}
-		keys = append(keys, k...)
-		snapshot, ok = h.parent[snapshot]
+		if len(chain) > len(h.keys) {
+			return nil, fmt.Errorf("parents of snapshot %s form a cycle", snapshot)
+		}
+		chain = append([]string{snapshot}, chain...)
+		parent, ok := h.parent[snapshot]
 		if !ok {
-			break
+			return chain, nil
 		}
+		snapshot = parent
 	}
-	return keys, nil
+}
+
+// Children returns the incremental snapshots taken directly on top of
+// snapshot, ordered by timestamp.
+func (h *SnapshotHistory) Children(snapshot string) []string {
+	var children []string
+	for _, s := range h.List() {
+		if parent, ok := h.parent[s]; ok && parent == snapshot {
+			children = append(children, s)
+		}
+	}
+	return children
+}
+
+// Descendants returns all snapshots that depend on snapshot, directly or
+// through other incremental snapshots, ordered by timestamp.
+func (h *SnapshotHistory) Descendants(snapshot string) []string {
+	var descendants []string
+	for _, s := range h.List() {
+		for t, i := s, 0; h.Parent(t) != t && i <= len(h.keys); i++ {
+			t = h.Parent(t)
+			if t == snapshot {
+				descendants = append(descendants, s)
+				break
+			}
+		}
+	}
+	return descendants
+}
+
+// Depth returns the number of parents of snapshot, 0 for a full snapshot.
+func (h *SnapshotHistory) Depth(snapshot string) int {
+	depth := 0
+	for s := snapshot; h.Parent(s) != s && depth <= len(h.keys); s = h.Parent(s) {
+		depth++
+	}
+	return depth
+}
+
+// Root returns the full snapshot at the start of the chain of snapshot.
+func (h *SnapshotHistory) Root(snapshot string) string {
+	for i := 0; h.Parent(snapshot) != snapshot && i <= len(h.keys); i++ {
+		snapshot = h.Parent(snapshot)
+	}
+	return snapshot
+}
+
+// IsFull returns true if snapshot is a full snapshot.
+func (h *SnapshotHistory) IsFull(snapshot string) bool {
+	_, ok := h.parent[snapshot]
+	return !ok
+}
+
+// LatestFull returns the most recent full snapshot, or an empty string
+// if there is none.
+func (h *SnapshotHistory) LatestFull() string {
+	list := h.List()
+	for i := len(list) - 1; i >= 0; i-- {
+		if h.IsFull(list[i]) {
+			return list[i]
+		}
+	}
+	return ""
+}
+
+// DataTime returns the timestamp the data of snapshot was taken at. This
+// is the snapshot itself, except for consolidated snapshots which hold
+// the data of an earlier snapshot.
+func (h *SnapshotHistory) DataTime(snapshot string) string {
+	if m, ok := h.manifests[snapshot]; ok && m.DataTime != "" {
+		return m.DataTime
+	}
+	return snapshot
+}
+
+// Latest returns the snapshot holding the most recent data, taken no
+// later than until unless until is empty, or an empty string if there is
+// none. Of snapshots holding the same data the newest one wins.
+func (h *SnapshotHistory) Latest(until string) string {
+	latest := ""
+	for _, snapshot := range h.List() {
+		t := h.DataTime(snapshot)
+		if (until == "" || t <= until) && (latest == "" || t >= h.DataTime(latest)) {
+			latest = snapshot
+		}
+	}
+	return latest
+}
+
+// SchemaKey returns the key holding the keyspace schema of a snapshot.
+func (h *SnapshotHistory) SchemaKey(snapshot string) (string, error) {
+	if m, ok := h.manifests[snapshot]; ok && m.Schema != "" {
+		return m.Schema, nil
+	}
+	for _, key := range h.keys[snapshot] {
+		if !isDataKey(key) && strings.Contains(path.Base(key), ".schema") {
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("did not find schema for snapshot %s", snapshot)
+}
+
+// Objects returns every key stored for a snapshot itself, including its
+// schema and manifest but not keys of parent snapshots.
+func (h *SnapshotHistory) Objects(snapshot string) []string {
+	var keys []string
+	if key, ok := h.manifest[snapshot]; ok {
+		keys = append(keys, key)
+	}
+	return append(keys, h.keys[snapshot]...)
 }
 
 // Valid returns true if a valid snapshot.
@@ -74,7 +297,60 @@ func (h *SnapshotHistory) Parent(snapshot string) string {
 	return snapshot
 }
 
-// String representation of snapshot history.
+// SnapshotInfo summarizes a snapshot.
+type SnapshotInfo struct {
+	Keyspace  string   `json:"keyspace" yaml:"keyspace"`
+	Timestamp string   `json:"timestamp" yaml:"timestamp"`
+	Type      string   `json:"type" yaml:"type"`
+	Parent    string   `json:"parent,omitempty" yaml:"parent,omitempty"`
+	Depth     int      `json:"depth" yaml:"depth"`
+	Objects   int      `json:"objects" yaml:"objects"`
+	Bytes     int64    `json:"bytes" yaml:"bytes"`
+	Hosts     []string `json:"hosts" yaml:"hosts"`
+	Schema    bool     `json:"schema" yaml:"schema"`
+}
+
+// Info returns a summary of a snapshot. Depth is the number of parents
+// an incremental snapshot has, 0 for full snapshots.
+func (h *SnapshotHistory) Info(snapshot string) *SnapshotInfo {
+	info := &SnapshotInfo{
+		Timestamp: snapshot,
+		Type:      "full",
+		Objects:   len(h.Objects(snapshot)),
+		Bytes:     h.size[snapshot],
+		Hosts:     []string{},
+	}
+	if parent := h.Parent(snapshot); parent != snapshot {
+		info.Type = "incremental"
+		info.Parent = parent
+	}
+	info.Depth = h.Depth(snapshot)
+	hosts := make(map[string]bool)
+	for _, key := range h.keys[snapshot] {
+		if isDataKey(key) {
+			hosts[keyParts(key)[4]] = true
+		}
+	}
+	if m, ok := h.manifests[snapshot]; ok {
+		for _, obj := range m.Objects {
+			if obj.Blob != "" {
+				info.Objects++
+				hosts[obj.Host] = true
+			}
+		}
+	}
+	for host := range hosts {
+		info.Hosts = append(info.Hosts, host)
+	}
+	sort.Strings(info.Hosts)
+	_, err := h.SchemaKey(snapshot)
+	info.Schema = err == nil
+	return info
+}
+
+// String representation of snapshot history. Every incremental snapshot
+// is nested below its parent. Snapshots whose parent no longer exists are
+// shown at the top level.
 func (h *SnapshotHistory) String() string {
 
 	list := h.List()
@@ -83,10 +359,22 @@ func (h *SnapshotHistory) String() string {
 	}
 	str := ""
 	for _, timestamp := range list {
-		if _, ok := h.parent[timestamp]; ok {
-			str = fmt.Sprintf("%s     ", str)
+		if parent, ok := h.parent[timestamp]; !ok || !h.Valid(parent) {
+			str = h.tree(str, timestamp, 0)
 		}
-		str = fmt.Sprintf("%s+-- %s\n", str, timestamp)
+	}
+	return str
+}
+
+// tree appends snapshot and, nested below it, all of its children to str.
+func (h *SnapshotHistory) tree(str, snapshot string, depth int) string {
+	if depth > len(h.keys) {
+		return str
+	}
+	str = fmt.Sprintf("%s%s+-- %s\n", str,
+		strings.Repeat("     ", depth), snapshot)
+	for _, child := range h.Children(snapshot) {
+		str = h.tree(str, child, depth+1)
 	}
 	return str
 }
@@ -0,0 +1,59 @@
+package priam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	h := testHistory()
+	tests := []struct {
+		snapshot string
+		chain    []string
+		err      bool
+	}{
+		{"2026-03-01_000000", []string{"2026-03-01_000000"}, false},
+		{"2026-03-02_000000", []string{"2026-03-01_000000", "2026-03-02_000000"}, false},
+		{"2026-03-07_000000", []string{"2026-03-05_000000", "2026-03-06_000000", "2026-03-07_000000"}, false},
+		{"2026-03-03_000000", nil, true},
+	}
+	for _, test := range tests {
+		chain, err := h.Chain(test.snapshot)
+		if (err != nil) != test.err {
+			t.Errorf("Chain(%s) error %v, want error %v", test.snapshot, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(chain, test.chain) {
+			t.Errorf("Chain(%s) = %v, want %v", test.snapshot, chain, test.chain)
+		}
+	}
+}
+
+func TestChainCycle(t *testing.T) {
+	h := NewSnapshotHistory()
+	h.Add("base/ks/2026-03-02_000000/2026-03-01_000000/10.0.0.1/data/ks/t-1/mc-1-big-Data.db", 1)
+	h.Add("base/ks/2026-03-01_000000/2026-03-02_000000/10.0.0.1/data/ks/t-1/mc-1-big-Data.db", 1)
+	if _, err := h.Chain("2026-03-02_000000"); err == nil {
+		t.Errorf("Chain of a cycle did not fail")
+	}
+}
+
+func TestDescendants(t *testing.T) {
+	h := testHistory()
+	tests := []struct {
+		snapshot    string
+		descendants []string
+	}{
+		{"2026-03-01_000000", []string{"2026-03-02_000000"}},
+		{"2026-03-05_000000", []string{"2026-03-06_000000", "2026-03-07_000000"}},
+		{"2026-03-06_000000", []string{"2026-03-07_000000"}},
+		{"2026-03-07_000000", nil},
+		{"2026-03-09_000000", nil},
+	}
+	for _, test := range tests {
+		descendants := h.Descendants(test.snapshot)
+		if !reflect.DeepEqual(descendants, test.descendants) {
+			t.Errorf("Descendants(%s) = %v, want %v", test.snapshot, descendants, test.descendants)
+		}
+	}
+}
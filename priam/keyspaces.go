@@ -0,0 +1,217 @@
+package priam
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// systemKeyspaces are the keyspaces cassandra keeps for itself.
+var systemKeyspaces = map[string]bool{
+	"system":                true,
+	"system_auth":           true,
+	"system_distributed":    true,
+	"system_schema":         true,
+	"system_traces":         true,
+	"system_views":          true,
+	"system_virtual_schema": true,
+}
+
+// EachKeyspace runs command once for every keyspace selected by the
+// keyspace, keyspaces and all-keyspaces config parameters, taking all
+// keyspaces from those with backups in storage. Each run gets its own
+// copy of p, and all of them share one timestamp.
+func (p *Priam) EachKeyspace(command func(*Priam) error) error {
+	keyspaces, err := p.keyspaces(false)
+	if err != nil {
+		return err
+	}
+	if len(keyspaces) == 1 {
+		return command(p.forKeyspace(keyspaces[0], p.timestamp, nil))
+	}
+	return p.eachKeyspace(keyspaces, p.NewTimestamp(), nil, command)
+}
+
+// BackupKeyspaces backs up every selected keyspace, taking all keyspaces
+// from the cassandra cluster. Several keyspaces are snapshotted together
+// with one nodetool snapshot on every host, so their backups are
+// consistent with each other, and the cluster schema is taken once.
+func (p *Priam) BackupKeyspaces() error {
+	keyspaces, err := p.keyspaces(true)
+	if err != nil {
+		return err
+	}
+	if len(keyspaces) == 1 {
+		return p.forKeyspace(keyspaces[0], p.timestamp, nil).Backup()
+	}
+	if p.config.TargetKeyspace != "" {
+		return fmt.Errorf("target keyspace needs a single keyspace (target-keyspace)")
+	}
+
+	timestamp := p.NewTimestamp()
+	run, err := p.startRun(keyspaces, timestamp)
+	if err != nil {
+		return err
+	}
+	defer p.endRun(run)
+	return p.eachKeyspace(keyspaces, timestamp, run, (*Priam).Backup)
+}
+
+// eachKeyspace runs command for each of several keyspaces with a shared
+// timestamp. A failure for one keyspace does not stop the others. Point
+// in time restores of several keyspaces need a single restart, so their
+// replay lists are merged into one.
+func (p *Priam) eachKeyspace(keyspaces []string, timestamp string, run *backupRun,
+	command func(*Priam) error) error {
+
+	if p.config.TargetKeyspace != "" {
+		return fmt.Errorf("target keyspace needs a single keyspace (target-keyspace)")
+	}
+	var failed []string
+	var restart *restartRequired
+	for _, keyspace := range keyspaces {
+		glog.Infof("keyspace: %s", keyspace)
+		err := command(p.forKeyspace(keyspace, timestamp, run))
+		if r, ok := errors.Cause(err).(*restartRequired); ok {
+			if restart == nil {
+				restart = r
+			} else {
+				restart.replay = append(restart.replay, r.replay...)
+			}
+			continue
+		}
+		if err != nil {
+			glog.Errorf("keyspace %s: %v", keyspace, err)
+			failed = append(failed, keyspace)
+		}
+	}
+	if len(failed) > 0 {
+		if restart != nil {
+			glog.Warning(restart)
+		}
+		return fmt.Errorf("failed for keyspaces: %s", strings.Join(failed, ", "))
+	}
+	if restart != nil {
+		return restart
+	}
+	return nil
+}
+
+// forKeyspace returns a copy of p working on keyspace.
+func (p *Priam) forKeyspace(keyspace, timestamp string, run *backupRun) *Priam {
+	config := *p.config
+	config.Keyspace = keyspace
+	return &Priam{
+		agent:     p.agent,
+		cassandra: NewCassandra(&config, p.agent),
+		codec:     p.codec,
+		config:    &config,
+		crypt:     p.crypt,
+		storage:   p.storage,
+		timestamp: timestamp,
+		run:       run,
+	}
+}
+
+// backupRun is what the backups of several keyspaces taken in one run
+// share: a snapshot of all of them on every host and the cluster schema.
+type backupRun struct {
+	keyspaces []string
+	timestamp string
+	hosts     []string
+	cluster   map[string][]byte
+	missing   map[string]string
+}
+
+// startRun snapshots keyspaces on every host at once, with timestamp as
+// the snapshot name, and takes the cluster schema. The snapshot also
+// flushes the keyspaces, so incremental backups pick up the same data.
+func (p *Priam) startRun(keyspaces []string, timestamp string) (*backupRun, error) {
+	hosts := p.cassandra.Hosts()
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("unable to get any cassandra hosts")
+	}
+	run := &backupRun{
+		keyspaces: keyspaces,
+		timestamp: timestamp,
+		hosts:     hosts,
+	}
+	glog.Infof("snapshot %d keyspaces with timestamp: %s", len(keyspaces), timestamp)
+	err := parallel(p.config.Parallelism, hosts, func(host string) error {
+		return p.cassandra.SnapshotKeyspaces(host, timestamp, keyspaces)
+	})
+	if err != nil {
+		p.endRun(run)
+		return nil, err
+	}
+	run.cluster, run.missing = p.captureCluster(hosts[0], timestamp)
+	return run, nil
+}
+
+// endRun removes what is left of the snapshot of a run on every host,
+// such as the snapshot of keyspaces backed up incrementally.
+func (p *Priam) endRun(run *backupRun) {
+	for _, host := range run.hosts {
+		if err := p.cassandra.ClearSnapshot(host, run.timestamp, run.keyspaces); err != nil {
+			glog.Warningf("%v", err)
+		}
+	}
+}
+
+// keyspaces returns the selected keyspaces. With all-keyspaces these are
+// all keyspaces of the cluster or all keyspaces backed up in storage,
+// system keyspaces only if system-keyspaces is set.
+func (p *Priam) keyspaces(cluster bool) ([]string, error) {
+	if !p.config.AllKeyspaces {
+		keyspaces := splitList(p.config.Keyspaces)
+		if len(keyspaces) == 0 {
+			keyspaces = []string{p.config.Keyspace}
+		}
+		if keyspaces[0] == "" {
+			return nil, fmt.Errorf("please provide keyspace (keyspace, keyspaces, all-keyspaces)")
+		}
+		return keyspaces, nil
+	}
+
+	var all []string
+	var err error
+	if cluster {
+		if all, err = p.cassandra.Keyspaces(p.config.Host); err != nil {
+			return nil, errors.Wrap(err, "error getting keyspaces of cluster")
+		}
+	} else if all, err = p.storedKeyspaces(); err != nil {
+		return nil, err
+	}
+
+	var keyspaces []string
+	for _, keyspace := range all {
+		if p.config.SystemKeyspaces || !systemKeyspaces[keyspace] {
+			keyspaces = append(keyspaces, keyspace)
+		}
+	}
+	if len(keyspaces) == 0 {
+		return nil, fmt.Errorf("no keyspaces found")
+	}
+	sort.Strings(keyspaces)
+	return keyspaces, nil
+}
+
+// storedKeyspaces returns all keyspaces with backups in storage.
+func (p *Priam) storedKeyspaces() ([]string, error) {
+	objects, err := p.storage.List(p.config.AwsBasePath + "/")
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting keyspaces in storage")
+	}
+	var keyspaces []string
+	seen := make(map[string]bool)
+	for _, obj := range objects {
+		parts := keyParts(obj.Key)
+		if len(parts) > 4 && parts[1] != commitlogsDir && !seen[parts[1]] {
+			seen[parts[1]] = true
+			keyspaces = append(keyspaces, parts[1])
+		}
+	}
+	return keyspaces, nil
+}
@@ -0,0 +1,90 @@
+package priam
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeyspaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stored := NewLocal(&Config{StoragePath: dir})
+	for _, key := range []string{
+		"base/ks/2026-03-01_000000/2026-03-01_000000/10.0.0.1/data/ks/t-1/mc-1-big-Data.db",
+		"base/ks/blobs/0123456789abcdef",
+		"base/other/2026-03-01_000000/2026-03-01_000000/other.schema",
+		"base/system_auth/2026-03-01_000000/2026-03-01_000000/system_auth.schema",
+		"base/commitlogs/10.0.0.1/CommitLog-7-1514764800000.log",
+		"base/ks/pending/2026-03-02_000000",
+	} {
+		if err := stored.Put(key, strings.NewReader("data"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	empty, err := ioutil.TempDir("", "priam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+
+	tests := []struct {
+		name   string
+		config Config
+		empty  bool
+		want   []string
+		err    bool
+	}{
+		{
+			name:   "keyspace",
+			config: Config{Keyspace: "ks"},
+			want:   []string{"ks"},
+		},
+		{
+			name:   "keyspaces",
+			config: Config{Keyspace: "ks", Keyspaces: "b, a"},
+			want:   []string{"b", "a"},
+		},
+		{
+			name: "no keyspace",
+			err:  true,
+		},
+		{
+			name:   "all keyspaces",
+			config: Config{AllKeyspaces: true},
+			want:   []string{"ks", "other"},
+		},
+		{
+			name:   "all with system keyspaces",
+			config: Config{AllKeyspaces: true, SystemKeyspaces: true},
+			want:   []string{"ks", "other", "system_auth"},
+		},
+		{
+			name:   "nothing stored",
+			config: Config{AllKeyspaces: true},
+			empty:  true,
+			err:    true,
+		},
+	}
+	for _, test := range tests {
+		config := test.config
+		config.AwsBasePath = "base"
+		p := &Priam{config: &config, storage: stored}
+		if test.empty {
+			p.storage = NewLocal(&Config{StoragePath: empty})
+		}
+		got, err := p.keyspaces(false)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
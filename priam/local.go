@@ -0,0 +1,235 @@
+package priam
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// partialPrefix marks files that are still being written by Put.
+const partialPrefix = ".partial-"
+
+// metaPrefix marks files that hold metadata of the object with the rest
+// of the name.
+const metaPrefix = ".meta-"
+
+// Local stores backups in a directory on the local filesystem, such as
+// an NFS mount, using the same key layout as S3. Object metadata is kept
+// as json in a hidden file next to the object.
+type Local struct {
+	root string
+}
+
+// NewLocal creates a new Local storage rooted at the storage-path
+// config parameter.
+func NewLocal(config *Config) *Local {
+	return &Local{
+		root: config.StoragePath,
+	}
+}
+
+// Put writes everything read from r to the file for key. The file and its
+// metadata are written under temporary names and renamed once complete so
+// that a failed backup never leaves a truncated object behind. Any old
+// file is removed before the metadata is renamed and the file itself is
+// renamed last, so metadata never sits next to a file it does not
+// describe.
+func (l *Local) Put(key string, r io.Reader, meta map[string]string) error {
+	file := l.file(key)
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		return errors.Wrapf(err, "error creating dir %s", dir)
+	}
+
+	tmp, err := ioutil.TempFile(dir, partialPrefix)
+	if err != nil {
+		return errors.Wrapf(err, "error creating file in %s", dir)
+	}
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "error writing key %s", key)
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "error closing key %s", key)
+	}
+	metaTmp, err := l.writeMeta(file, meta)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "error writing metadata for key %s", key)
+	}
+	if err = os.Remove(file); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmp.Name())
+		os.Remove(metaTmp)
+		return errors.Wrapf(err, "error replacing key %s", key)
+	}
+	if metaTmp == "" {
+		err = os.Remove(l.metaFile(file))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		err = os.Rename(metaTmp, l.metaFile(file))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		os.Remove(metaTmp)
+		return errors.Wrapf(err, "error writing metadata for key %s", key)
+	}
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		os.Remove(l.metaFile(file))
+		return errors.Wrapf(err, "error renaming key %s", key)
+	}
+	return nil
+}
+
+// Get opens the file for key and reads its metadata.
+func (l *Local) Get(key string) (io.ReadCloser, map[string]string, error) {
+	file := l.file(key)
+	meta, err := l.readMeta(file)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error reading metadata for key %s", key)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error opening key %s", key)
+	}
+	return f, meta, nil
+}
+
+// List walks the storage directory and returns all objects whose key
+// begins with prefix.
+func (l *Local) List(prefix string) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+
+	// only walk the part of the tree that can match prefix
+	start := l.file(path.Dir(strings.TrimPrefix(prefix, "/") + "x"))
+	if _, err := os.Stat(start); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	err := filepath.Walk(start, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), partialPrefix) ||
+			strings.HasPrefix(info.Name(), metaPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, file)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, strings.TrimPrefix(prefix, "/")) {
+			return nil
+		}
+		objects = append(objects, &ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing %s", l.root)
+	}
+	return objects, nil
+}
+
+// Delete removes the file for key along with any parent directories
+// left empty.
+func (l *Local) Delete(key string) error {
+	glog.V(2).Infof("delete key: %s", key)
+	file := l.file(key)
+	if err := os.Remove(file); err != nil {
+		return errors.Wrapf(err, "error deleting key %s", key)
+	}
+	os.Remove(l.metaFile(file))
+	root := filepath.Clean(l.root)
+	for dir := filepath.Dir(file); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Stat returns size, modification time and metadata of the file for key.
+func (l *Local) Stat(key string) (*ObjectInfo, error) {
+	file := l.file(key)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting info for key %s", key)
+	}
+	meta, err := l.readMeta(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading metadata for key %s", key)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		Metadata:     meta,
+	}, nil
+}
+
+// writeMeta writes meta to a temporary file next to file and returns its
+// name, or an empty string if there is no metadata.
+func (l *Local) writeMeta(file string, meta map[string]string) (string, error) {
+	if len(meta) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), partialPrefix)
+	if err != nil {
+		return "", err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// readMeta returns the metadata stored for file, if any.
+func (l *Local) readMeta(file string) (map[string]string, error) {
+	meta := make(map[string]string)
+	data, err := ioutil.ReadFile(l.metaFile(file))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// metaFile returns the name of the file holding metadata for file.
+func (l *Local) metaFile(file string) string {
+	return filepath.Join(filepath.Dir(file), metaPrefix+filepath.Base(file))
+}
+
+// file returns the path of the file holding key.
+func (l *Local) file(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+key)))
+}
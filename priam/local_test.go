@@ -0,0 +1,71 @@
+package priam
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocalPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := NewLocal(&Config{StoragePath: dir})
+	key := "base/ks/2026-03-01_000000/2026-03-01_000000/manifest.json"
+
+	tests := []struct {
+		name string
+		data string
+		meta map[string]string
+	}{
+		{"new", "first", map[string]string{"priam-codec": "gzip"}},
+		{"replace metadata", "second", map[string]string{"priam-codec": "zstd"}},
+		{"remove metadata", "third", nil},
+	}
+	for _, test := range tests {
+		if err := l.Put(key, strings.NewReader(test.data), test.meta); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		r, meta, err := l.Get(key)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.data {
+			t.Errorf("%s: got %q, want %q", test.name, data, test.data)
+		}
+		want := test.meta
+		if want == nil {
+			want = map[string]string{}
+		}
+		if !reflect.DeepEqual(meta, want) {
+			t.Errorf("%s: got metadata %v, want %v", test.name, meta, want)
+		}
+
+		// temporary and metadata files are never listed
+		objects, err := l.List("base/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objects) != 1 || objects[0].Key != key {
+			t.Errorf("%s: listed %d objects, want only %s", test.name, len(objects), key)
+		}
+	}
+
+	if err := l.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("delete left %d entries behind", len(entries))
+	}
+}
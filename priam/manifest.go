@@ -0,0 +1,122 @@
+package priam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// manifestName is the name of the manifest written under the timestamp
+// prefix of every snapshot.
+const manifestName = "manifest.json"
+
+// Manifest describes everything stored for one snapshot. Tables and
+// ExcludeTables hold the table filters of a backup of only some tables.
+// ClusterSchema holds the keys of the cluster level schema artifacts by
+// name, and ClusterSchemaErrors why those missing could not be backed
+// up. DataTime is set on consolidated snapshots to the timestamp of the
+// snapshot their data was taken at.
+type Manifest struct {
+	Keyspace            string              `json:"keyspace"`
+	Timestamp           string              `json:"timestamp"`
+	Parent              string              `json:"parent,omitempty"`
+	DataTime            string              `json:"data_time,omitempty"`
+	CassandraVersion    string              `json:"cassandra_version"`
+	Tokens              map[string][]string `json:"tokens"`
+	Schema              string              `json:"schema"`
+	Tables              []string            `json:"tables,omitempty"`
+	ExcludeTables       []string            `json:"exclude_tables,omitempty"`
+	ClusterSchema       map[string]string   `json:"cluster_schema,omitempty"`
+	ClusterSchemaErrors map[string]string   `json:"cluster_schema_errors,omitempty"`
+	Objects             []*ManifestObject   `json:"objects"`
+}
+
+// ManifestObject describes a single backed up file. Size and Sha256 are
+// of the original file, CompressedSize is the size as stored. Blob is set
+// if the contents are stored in a shared blob rather than under Key.
+type ManifestObject struct {
+	Key            string `json:"key"`
+	Blob           string `json:"blob,omitempty"`
+	Host           string `json:"host"`
+	DataDir        string `json:"data_dir"`
+	Table          string `json:"table"`
+	TableID        string `json:"table_id,omitempty"`
+	File           string `json:"file"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressed_size"`
+	Sha256         string `json:"sha256"`
+}
+
+// manifestKey returns the key of the manifest for a snapshot.
+func (p *Priam) manifestKey(parent, timestamp string) string {
+	return fmt.Sprintf("/%s/%s/%s/%s/%s",
+		p.config.AwsBasePath, p.config.Keyspace,
+		parent, timestamp, manifestName)
+}
+
+// writeManifest uploads the manifest of a snapshot. It is encrypted like
+// every other object but never compressed.
+func (p *Priam) writeManifest(parent string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error encoding manifest")
+	}
+	key := p.manifestKey(parent, m.Timestamp)
+	if _, err = p.putObject(key, bytes.NewReader(data), codecs["none"]); err != nil {
+		return errors.Wrapf(err, "error uploading manifest %s", key)
+	}
+	return nil
+}
+
+// readManifest downloads and decodes the manifest stored under key.
+func (p *Priam) readManifest(key string) (*Manifest, error) {
+	r, _, err := p.openKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading manifest %s", key)
+	}
+	var m Manifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "error decoding manifest %s", key)
+	}
+	return &m, nil
+}
+
+// tableIDPattern matches the id cassandra appends to table directories.
+var tableIDPattern = regexp.MustCompile("^(.+)-([0-9a-f]{32})$")
+
+// tableName returns the name of the table stored in directory dir.
+func tableName(dir string) string {
+	if m := tableIDPattern.FindStringSubmatch(dir); m != nil {
+		return m[1]
+	}
+	return dir
+}
+
+// parseDataFile splits the path of a file in a snapshots or backups
+// directory of a cassandra table into its data directory, table name
+// and table id.
+func parseDataFile(file string) (string, string, string) {
+	parts := strings.Split(path.Clean(file), "/")
+	for i := len(parts) - 2; i > 2; i-- {
+		if parts[i] != "snapshots" && parts[i] != "backups" {
+			continue
+		}
+		dataDir := strings.Join(parts[:i-2], "/")
+		table := parts[i-1]
+		if m := tableIDPattern.FindStringSubmatch(table); m != nil {
+			return dataDir, m[1], m[2]
+		}
+		return dataDir, table, ""
+	}
+	return "", "", ""
+}
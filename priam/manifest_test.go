@@ -0,0 +1,109 @@
+package priam
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDataFile(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		file    string
+		dataDir string
+		table   string
+		tableID string
+	}{
+		{"/var/lib/cassandra/data/ks/t-" + id + "/snapshots/2026-03-01_000000/mc-1-big-Data.db",
+			"/var/lib/cassandra/data", "t", id},
+		{"/var/lib/cassandra/data/ks/t-" + id + "/backups/mc-1-big-Data.db",
+			"/var/lib/cassandra/data", "t", id},
+		{"/data1/ks/my-table/snapshots/2026-03-01_000000/mc-1-big-Data.db",
+			"/data1", "my-table", ""},
+		{"/var/lib/cassandra/data/ks/t-" + id + "/mc-1-big-Data.db", "", "", ""},
+		{"mc-1-big-Data.db", "", "", ""},
+	}
+	for _, test := range tests {
+		dataDir, table, tableID := parseDataFile(test.file)
+		if dataDir != test.dataDir || table != test.table || tableID != test.tableID {
+			t.Errorf("parseDataFile(%s) = %s, %s, %s, want %s, %s, %s", test.file,
+				dataDir, table, tableID, test.dataDir, test.table, test.tableID)
+		}
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	parent, timestamp := "2026-03-01_000000", "2026-03-02_000000"
+	m := &Manifest{
+		Keyspace:         "ks",
+		Timestamp:        timestamp,
+		Parent:           parent,
+		CassandraVersion: "4.0.1",
+		Tokens:           map[string][]string{"10.0.0.1": {"-100", "100"}},
+		Schema:           "base/ks/" + parent + "/" + timestamp + "/ks.schema.gz",
+		Objects: []*ManifestObject{{
+			Key:     "base/ks/" + parent + "/" + timestamp + "/10.0.0.1/data/ks/t-1/mc-1-big-Data.db.gz",
+			Host:    "10.0.0.1",
+			DataDir: "/var/lib/cassandra/data",
+			Table:   "t",
+			File:    "mc-1-big-Data.db",
+			Size:    10,
+			Sha256:  "abcd",
+		}},
+	}
+	tests := []struct {
+		name  string
+		crypt *Crypt
+	}{
+		{"plain", nil},
+		{"encrypted", testCrypt(t, dir, "key")},
+	}
+	for _, test := range tests {
+		config := &Config{AwsBasePath: "base", Keyspace: "ks", StoragePath: dir + "/" + test.name}
+		p := &Priam{config: config, crypt: test.crypt, storage: NewLocal(config)}
+		if err := p.storage.Put(m.Schema, strings.NewReader("schema"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.writeManifest(parent, m); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got, err := p.readManifest(p.manifestKey(parent, timestamp))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("%s: read %+v, want %+v", test.name, got, m)
+		}
+
+		// history is built from the manifest
+		if err := p.SnapshotHistory(); err != nil {
+			t.Fatal(err)
+		}
+		if p.hist.Parent(timestamp) != parent || p.hist.Manifest(timestamp) == nil {
+			t.Errorf("%s: history does not describe %s", test.name, timestamp)
+		}
+	}
+
+	// broken and missing manifests
+	config := &Config{AwsBasePath: "base", Keyspace: "ks", StoragePath: dir + "/broken"}
+	p := &Priam{config: config, storage: NewLocal(config)}
+	key := p.manifestKey(parent, timestamp)
+	if err := p.storage.Put(key, strings.NewReader("{"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.readManifest(key); err == nil {
+		t.Errorf("reading a broken manifest did not fail")
+	}
+	if _, err := p.readManifest(p.manifestKey(parent, parent)); err == nil {
+		t.Errorf("reading a missing manifest did not fail")
+	}
+}
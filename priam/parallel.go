@@ -0,0 +1,46 @@
+package priam
+
+import (
+	"sync"
+)
+
+// parallel calls fn for every item using at most n goroutines at a time
+// and returns the first error encountered. Once an error occurs items
+// that have not been started yet are skipped.
+func parallel(n int, items []string, fn func(item string) error) error {
+	if n < 1 {
+		n = 1
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, n)
+
+	for _, item := range items {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(item string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(item); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(item)
+	}
+	wg.Wait()
+	return firstErr
+}
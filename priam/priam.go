@@ -1,53 +1,133 @@
 package priam
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 )
 
-// Priam object provides backup and restore of cassandra DB to AWS S3.
+// Priam object provides backup and restore of cassandra DB to a storage
+// backend such as AWS S3.
 type Priam struct {
 	agent     *Agent
 	cassandra *Cassandra
+	codec     *Codec
 	config    *Config
-	s3        *S3
+	crypt     *Crypt
+	storage   Storage
 	hist      *SnapshotHistory
+	timestamp string     // timestamp shared by runs for several keyspaces
+	run       *backupRun // snapshot shared by backups of several keyspaces
 }
 
 // New returns a new Priam object.
-func New(config *Config) *Priam {
+func New(config *Config) (*Priam, error) {
+	storage, err := NewStorage(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating storage backend")
+	}
+	codec, err := NewCodec(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	crypt, err := NewCrypt(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading encryption key")
+	}
 	agent := NewAgent(config)
 	return &Priam{
 		agent:     agent,
 		config:    config,
 		cassandra: NewCassandra(config, agent),
-		s3:        NewS3(config, agent),
-	}
+		codec:     codec,
+		crypt:     crypt,
+		storage:   storage,
+	}, nil
 }
 
-// History prints the current list of backups in S3.
+// History prints the current list of backups in storage, as a tree by
+// default or in the format given by the format config parameter.
 func (p *Priam) History() error {
 
-	// get snapshot history
-	if err := p.SnapshotHistory(); err != nil {
-		return errors.Wrap(err, "error getting snapshot history")
+	keyspaces, err := p.keyspaces(false)
+	if err != nil {
+		return err
+	}
+
+	// get snapshot history of every keyspace
+	infos := []*SnapshotInfo{}
+	for _, keyspace := range keyspaces {
+		k := p.forKeyspace(keyspace, "", nil)
+		if err := k.SnapshotHistory(); err != nil {
+			return errors.Wrapf(err, "error getting snapshot history of %s", keyspace)
+		}
+		if p.config.Format == "" || p.config.Format == "tree" {
+			if len(keyspaces) > 1 {
+				fmt.Printf("backup list of %s:\n%s", keyspace, k.hist)
+			} else {
+				fmt.Printf("backup list:\n%s", k.hist)
+			}
+			continue
+		}
+		for _, snapshot := range k.hist.List() {
+			info := k.hist.Info(snapshot)
+			info.Keyspace = keyspace
+			infos = append(infos, info)
+		}
+	}
+
+	switch p.config.Format {
+	case "", "tree":
+		// printed for every keyspace above
+	case "json":
+		data, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "error encoding history")
+		}
+		fmt.Printf("%s\n", data)
+	case "yaml":
+		data, err := yaml.Marshal(infos)
+		if err != nil {
+			return errors.Wrap(err, "error encoding history")
+		}
+		fmt.Printf("%s", data)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "KEYSPACE\tTIMESTAMP\tTYPE\tPARENT\tDEPTH\tOBJECTS\tBYTES\tHOSTS\tSCHEMA\n")
+		for _, info := range infos {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%t\n",
+				info.Keyspace, info.Timestamp, info.Type, info.Parent, info.Depth,
+				info.Objects, info.Bytes, len(info.Hosts), info.Schema)
+		}
+		w.Flush()
+	default:
+		return fmt.Errorf("unknown history format '%s'", p.config.Format)
 	}
-	fmt.Printf("backup list:\n%s", p.hist)
 	return nil
 }
 
 // Backup flushes all cassandra tables to disk identifies the appropriate
-// files and copies them to the specified AWS S3 bucket.
+// files and copies them to the configured storage backend.
 func (p *Priam) Backup() error {
 
 	glog.Infof("start taking backup...")
 
-	// get all cassandra hosts
-	hosts := p.cassandra.Hosts()
+	// get all cassandra hosts, those snapshotted when part of a run
+	var hosts []string
+	if p.run != nil {
+		hosts = p.run.hosts
+	} else {
+		hosts = p.cassandra.Hosts()
+	}
 	if len(hosts) == 0 {
 		return fmt.Errorf("unable to get any cassandra hosts")
 	}
@@ -61,6 +141,19 @@ func (p *Priam) Backup() error {
 	timestamp := p.NewTimestamp()
 	glog.Infof("generating snapshot with timestamp: %s", timestamp)
 
+	// mark the backup in progress so prune keeps the blobs it reuses
+	if p.config.Dedup {
+		marker := p.pendingKey(timestamp)
+		if err := p.storage.Put(marker, strings.NewReader(""), nil); err != nil {
+			return errors.Wrap(err, "error marking backup in progress")
+		}
+		defer func() {
+			if err := p.storage.Delete(marker); err != nil {
+				glog.Warningf("unable to remove marker of backup in progress: %v", err)
+			}
+		}()
+	}
+
 	// get parent timestamp
 	parent := timestamp
 	snapshots := p.hist.List()
@@ -70,32 +163,69 @@ func (p *Priam) Backup() error {
 		return fmt.Errorf("new timestamp %s less than last", timestamp)
 	}
 
-	// assign parent timestamp if incremental
+	// assign parent timestamp if incremental, the snapshot with the most
+	// recent data which may be older than a consolidated snapshot
 	if len(snapshots) > 0 && p.config.Incremental {
-		parent = snapshots[len(snapshots)-1]
+		parent = p.hist.Latest("")
+		if reason := p.promoteToFull(parent); reason != "" {
+			glog.Infof("taking full backup instead of incremental: %s", reason)
+			parent = timestamp
+			p.config.Incremental = false
+		}
 	} else {
 		p.config.Incremental = false
 	}
 	glog.Infof("timestamp of parent snapshot: %s", parent)
 
 	// perform schema backup
-	if err := p.schemaBackup(parent, timestamp, hosts[0]); err != nil {
+	schemaKey, err := p.schemaBackup(parent, timestamp, hosts[0])
+	if err != nil {
 		return errors.Wrap(err, "schema backup failed")
 	}
 
-	// take snapshot on each host
-	// TODO: this could be done in parallel
-	for _, host := range hosts {
+	// start manifest of this snapshot
+	manifest := &Manifest{
+		Keyspace:      p.config.Keyspace,
+		Timestamp:     timestamp,
+		Tokens:        make(map[string][]string),
+		Schema:        strings.TrimPrefix(schemaKey, "/"),
+		Tables:        splitList(p.config.Tables),
+		ExcludeTables: splitList(p.config.ExcludeTables),
+	}
+	manifest.ClusterSchema, manifest.ClusterSchemaErrors = p.clusterBackup(parent, timestamp, hosts[0])
+	if len(manifest.ClusterSchemaErrors) == 0 {
+		manifest.ClusterSchemaErrors = nil
+	}
+	if parent != timestamp {
+		manifest.Parent = parent
+	}
+	if manifest.CassandraVersion, err = p.cassandra.Version(hosts[0]); err != nil {
+		glog.Warningf("unable to get cassandra version: %v", err)
+	}
+
+	// take snapshot on hosts in parallel
+	var mu sync.Mutex
+	err = parallel(p.config.Parallelism, hosts, func(host string) error {
 		glog.Infof("snapshot @ %s", host)
 
-		// create snapshot
-		files, dirs, err := p.cassandra.Snapshot(host, timestamp)
+		tokens, err := p.cassandra.Tokens(host)
+		if err != nil {
+			glog.Warningf("unable to get tokens @ %s: %v", host, err)
+		}
+
+		// create snapshot, unless taken for the whole run
+		snapshot := p.cassandra.Snapshot
+		if p.run != nil {
+			snapshot = p.cassandra.SnapshotFiles
+		}
+		files, dirs, err := snapshot(host, timestamp)
 		if err != nil {
 			return errors.Wrapf(err, "snapshot @ %s", host)
 		}
 
-		// upload files to s3
-		if err = p.s3.UploadFiles(parent, timestamp, host, files); err != nil {
+		// upload files to storage
+		objects, err := p.uploadFiles(parent, timestamp, host, files)
+		if err != nil {
 			return errors.Wrapf(err, "upload @ %s", host)
 		}
 
@@ -103,27 +233,70 @@ func (p *Priam) Backup() error {
 		if err = p.cassandra.deleteSnapshot(host, dirs); err != nil {
 			return errors.Wrapf(err, "delete @ %s", host)
 		}
+
+		mu.Lock()
+		manifest.Tokens[host] = tokens
+		manifest.Objects = append(manifest.Objects, objects...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	return nil
+
+	// write manifest once every host is done
+	sort.Slice(manifest.Objects, func(i, j int) bool {
+		return manifest.Objects[i].Key < manifest.Objects[j].Key
+	})
+	return p.writeManifest(parent, manifest)
 }
 
-func (p *Priam) schemaBackup(parent, timestamp, host string) error {
+// schemaBackup uploads the keyspace schema and returns its key.
+func (p *Priam) schemaBackup(parent, timestamp, host string) (string, error) {
 
 	// get schema backup
-	schemaFile, err := p.cassandra.SchemaBackup(host)
+	schemaFile, err := p.cassandra.SchemaBackup(host, timestamp)
 	if err != nil {
-		return errors.Wrap(err, "schema backup")
+		return "", errors.Wrap(err, "schema backup")
 	}
-	key := fmt.Sprintf("/%s/%s/%s/%s/%s.schema.gz",
-		p.config.AwsBasePath, p.config.Keyspace,
-		parent, timestamp, p.config.Keyspace)
+	key := p.schemaKey(parent, timestamp)
 
-	// upload files to s3
-	if err = p.s3.UploadFile(host, schemaFile, key); err != nil {
-		return errors.Wrapf(err, "schema upload @ %s", host)
+	// upload files to storage
+	if _, err = p.uploadFile(host, schemaFile, key); err != nil {
+		return "", errors.Wrapf(err, "schema upload @ %s", host)
 	}
+	p.agent.Run(host, fmt.Sprintf("rm -f %s", schemaFile))
 
-	return nil
+	return key, nil
+}
+
+// promoteToFull returns why an incremental backup on top of parent should
+// be taken as a full backup instead, or an empty string if it should not.
+func (p *Priam) promoteToFull(parent string) string {
+	chain, err := p.hist.Chain(parent)
+	if err != nil {
+		return err.Error()
+	}
+
+	// incrementals chained on the full snapshot, including the new one
+	if max := p.config.MaxIncChain; max > 0 && len(chain) > max {
+		return fmt.Sprintf("chain of %s already has %d incrementals (max-incremental-chain %d)",
+			chain[0], len(chain)-1, max)
+	}
+
+	// bytes of all incrementals relative to the full snapshot
+	if max := p.config.MaxIncRatio; max > 0 {
+		full := p.hist.Info(chain[0]).Bytes
+		var inc int64
+		for _, s := range chain[1:] {
+			inc += p.hist.Info(s).Bytes
+		}
+		if full > 0 && float64(inc)/float64(full) > max {
+			return fmt.Sprintf("incrementals of %s hold %d bytes, %.2f times its %d bytes (max-incremental-bytes-ratio %g)",
+				chain[0], inc, float64(inc)/float64(full), full, max)
+		}
+	}
+	return ""
 }
 
 // SnapshotHistory returns snapshot history
@@ -131,11 +304,25 @@ func (p *Priam) SnapshotHistory() error {
 	if p.hist != nil {
 		return nil
 	}
-	// get snapshot history from S3 if not already present
-	h, err := p.s3.SnapshotHistory()
+	// get snapshot history from storage if not already present
+	prefix := fmt.Sprintf("%s/%s/", p.config.AwsBasePath, p.config.Keyspace)
+	objects, err := p.storage.List(prefix)
 	if err != nil {
 		return errors.Wrap(err, "error getting snapshot history")
 	}
+	h := NewSnapshotHistory()
+	for _, obj := range objects {
+		h.Add(obj.Key, obj.Size)
+	}
+
+	// manifests describe their snapshots exactly
+	for _, key := range h.ManifestKeys() {
+		m, err := p.readManifest(key)
+		if err != nil {
+			return errors.Wrap(err, "error reading manifest")
+		}
+		h.AddManifest(m)
+	}
 	p.hist = h
 	return nil
 }
@@ -145,7 +332,10 @@ func (p *Priam) SnapshotHistory() error {
 // restore function to determine which backup is the latest as well as the
 // order of incremental backups.
 func (p *Priam) NewTimestamp() string {
-	return time.Now().Format("2006-01-02_150405")
+	if p.timestamp != "" {
+		return p.timestamp
+	}
+	return time.Now().Format(timestampFormat)
 }
 
 // Restore cassandra from a given snapshot.
@@ -155,57 +345,141 @@ func (p *Priam) Restore() error {
 
 	glog.Infof("start restoring keyspace: %s", p.config.Keyspace)
 
+	// parse restore time before anything is dropped
+	var until time.Time
+	if p.config.RestoreTime != "" {
+		var err error
+		if until, err = parseTimestamp(p.config.RestoreTime); err != nil {
+			return errors.Wrapf(err, "invalid restore time %s", p.config.RestoreTime)
+		}
+	}
+
 	// get all cassandra hosts
 	hosts := p.cassandra.Hosts()
 	if len(hosts) == 0 {
 		return fmt.Errorf("did not find valid cassandra hosts")
 	}
-	snapshot := p.config.Snapshot
 
-	// get snapshot history
-	if err := p.SnapshotHistory(); err != nil {
+	// determine which snapshot to restore to
+	snapshot, err := p.selectSnapshot()
+	if err != nil {
 		return err
 	}
-
-	// determine which snapshot to restore to
-	if snapshot == "" {
-		snapshots := p.hist.List()
-		if len(snapshots) > 0 {
-			snapshot = snapshots[len(snapshots)-1]
-		}
+	glog.Infof("restoring to snapshot: %s", snapshot)
+	if p.restoreKeyspace() != p.config.Keyspace {
+		glog.Infof("restoring into keyspace: %s", p.restoreKeyspace())
 	}
-	if snapshot == "" {
-		return fmt.Errorf("no existing backup to restore from")
+	if err := p.checkCluster(hosts[0], snapshot); err != nil {
+		return err
 	}
 
-	// check if this a valid snapshot
-	if !p.hist.Valid(snapshot) {
-		return fmt.Errorf("%s is not a valid snapshot", snapshot)
-	}
-	glog.Infof("restoring to snapshot: %s", snapshot)
+	if p.config.Mode == "additive" {
+
+		// keep schema and data, only create what is missing
+		if err := p.checkSchema(hosts[0], snapshot); err != nil {
+			return err
+		}
+		if err := p.createSchema(hosts[0], snapshot); err != nil {
+			return errors.Wrap(err, "error creating schema")
+		}
+	} else if p.partialRestore(snapshot) {
 
-	// drop keyspace
-	if err := p.deleteKeyspace(hosts[0]); err != nil {
-		return errors.Wrap(err, "error deleting keyspace")
+		// only replace data of the restored tables
+		tables, err := p.restoreTables(snapshot)
+		if err != nil {
+			return err
+		}
+		glog.Infof("restoring tables: %s", strings.Join(tables, ", "))
+		if err := p.createSchema(hosts[0], snapshot); err != nil {
+			return errors.Wrap(err, "error creating schema")
+		}
+		if err := p.truncateTables(hosts[0], tables); err != nil {
+			return errors.Wrap(err, "error truncating tables")
+		}
+	} else {
+
+		// drop keyspace
+		if err := p.deleteKeyspace(hosts[0]); err != nil {
+			return errors.Wrap(err, "error deleting keyspace")
+		}
+
+		// create schema
+		if err := p.createSchema(hosts[0], snapshot); err != nil {
+			return errors.Wrap(err, "error creating schema")
+		}
 	}
 
-	// create schema
-	if err := p.createSchema(hosts[0], snapshot); err != nil {
-		return errors.Wrap(err, "error creating schema")
+	// recreate roles and grants
+	if p.config.RestoreAuth {
+		if err := p.restoreAuth(hosts[0], snapshot); err != nil {
+			return errors.Wrap(err, "error restoring roles")
+		}
 	}
 
 	// load data
-	if err := p.loadSnapshot(hosts[0], snapshot); err != nil {
+	if p.config.Loader == "refresh" {
+		err = p.refreshSnapshot(hosts, snapshot)
+	} else {
+		err = p.loadSnapshot(hosts[0], snapshot)
+	}
+	if err != nil {
 		return errors.Wrap(err, "error loading snapshot")
 	}
+
+	// replay commitlogs up to restore time
+	if p.config.RestoreTime != "" {
+		tables, err := p.restoreTables(snapshot)
+		if err != nil {
+			return err
+		}
+		if err := p.stageCommitlogs(hosts, p.hist.DataTime(snapshot), until); err != nil {
+			return errors.Wrap(err, "error staging commitlogs")
+		}
+		var replay []string
+		for _, table := range tables {
+			replay = append(replay, fmt.Sprintf("%s.%s", p.config.Keyspace, table))
+		}
+		return &restartRequired{replay: replay, until: until}
+	}
 	return nil
 }
 
+// selectSnapshot returns the snapshot given by the snapshot config
+// parameter, or the latest snapshot if none is given. With a restore
+// time the latest snapshot taken before it is used.
+func (p *Priam) selectSnapshot() (string, error) {
+
+	// get snapshot history
+	if err := p.SnapshotHistory(); err != nil {
+		return "", err
+	}
+
+	restoreTime := p.config.RestoreTime
+	if restoreTime != "" && p.config.Snapshot != "" && p.hist.DataTime(p.config.Snapshot) > restoreTime {
+		return "", fmt.Errorf("snapshot %s was taken after restore time %s",
+			p.config.Snapshot, restoreTime)
+	}
+
+	snapshot := p.config.Snapshot
+	if snapshot == "" {
+		snapshot = p.hist.Latest(restoreTime)
+	}
+	if snapshot == "" {
+		return "", fmt.Errorf("no existing backup to restore from")
+	}
+
+	// check if this a valid snapshot
+	if !p.hist.Valid(snapshot) {
+		return "", fmt.Errorf("%s is not a valid snapshot", snapshot)
+	}
+	return snapshot, nil
+}
+
 // deleteKeyspace deletes keyspace.
 func (p *Priam) deleteKeyspace(host string) error {
 
 	cmd := fmt.Sprintf("echo 'DROP KEYSPACE IF EXISTS %s;' | %s",
-		p.config.Keyspace, p.config.CqlshPath)
+		p.restoreKeyspace(), p.config.CqlshPath)
 	_, err := p.agent.Run(host, cmd)
 	if err != nil {
 		return err
@@ -216,34 +490,25 @@ func (p *Priam) deleteKeyspace(host string) error {
 // createSchema creates the schema from backup for given snapshot.
 func (p *Priam) createSchema(host, snapshot string) error {
 
-	// get parent
-	parent := p.hist.Parent(snapshot)
-
 	// schema key
-	key := fmt.Sprintf("/%s/%s/%s/%s/%s.schema.gz",
-		p.config.AwsBasePath, p.config.Keyspace,
-		parent, snapshot, p.config.Keyspace)
+	key, err := p.hist.SchemaKey(snapshot)
+	if err != nil {
+		return err
+	}
 
 	localTmpDir := fmt.Sprintf("%s/local", p.config.TempDir)
-	remoteTmpDir := fmt.Sprintf("%s/remote", p.config.TempDir)
 
 	// download schema file
-	localFile, err := p.s3.downloadKey(key, localTmpDir)
+	localFile, err := p.downloadKey(key, localTmpDir)
 	if err != nil {
 		return errors.Wrap(err, "error downloading schema key")
 	}
-
-	// copy schema file to cassandra host
-	remoteFile := strings.TrimSuffix(path.Join(remoteTmpDir, key), ".gz")
-	err = p.agent.UploadFile(host, localFile, path.Dir(remoteFile))
-	if err != nil {
-		return errors.Wrap(err, "error uploading file")
+	if localFile, err = p.prepareSchema(localFile, snapshot); err != nil {
+		return errors.Wrap(err, "error preparing schema")
 	}
 
 	// create schema
-	cmd := fmt.Sprintf("cat %s | %s", remoteFile, p.config.CqlshPath)
-	_, err = p.agent.Run(host, cmd)
-	if err != nil {
+	if err = p.runCql(host, localFile); err != nil {
 		return errors.Wrap(err, "failed creating schema")
 	}
 	return nil
@@ -256,13 +521,13 @@ func (p *Priam) loadSnapshot(host, snapshot string) error {
 	remoteTmpDir := fmt.Sprintf("%s/remote", p.config.TempDir)
 
 	// get list of keys to download
-	keys, err := p.hist.Keys(snapshot)
+	keys, err := p.restoreKeys(snapshot)
 	if err != nil {
 		return errors.Wrap(err, "failed to get all keys")
 	}
 
 	// download keys
-	files, err := p.s3.downloadKeys(keys, localTmpDir)
+	files, err := p.downloadKeys(keys, localTmpDir)
 	if err != nil {
 		return errors.Wrap(err, "error downloading keys")
 	}
@@ -281,6 +546,17 @@ func (p *Priam) loadSnapshot(host, snapshot string) error {
 	return nil
 }
 
+// restoreKey returns key with the keyspace directory of the file renamed
+// to the keyspace being restored into, as sstableloader takes keyspace
+// and table from the directories a file is in.
+func (p *Priam) restoreKey(key string) string {
+	parts := keyParts(key)
+	if len(parts) > 7 {
+		parts[len(parts)-3] = p.restoreKeyspace()
+	}
+	return strings.Join(parts, "/")
+}
+
 // uploadFilesToHost copies cassandra files to a local directory on
 // one of the cassandra hosts.
 func (p *Priam) uploadFilesToHost(host, remoteTmpDir string,
@@ -289,7 +565,7 @@ func (p *Priam) uploadFilesToHost(host, remoteTmpDir string,
 	dirs := make(map[string]bool)
 	for key, localFile := range files {
 		glog.V(2).Infof("copy to %s: %s", host, key)
-		remoteDir := path.Dir(fmt.Sprintf("%s/%s", remoteTmpDir, key))
+		remoteDir := path.Dir(fmt.Sprintf("%s/%s", remoteTmpDir, p.restoreKey(key)))
 		err := p.agent.UploadFile(host, localFile, remoteDir)
 		if err != nil {
 			return nil, errors.Wrap(err, "error uploading backup files to host")
@@ -0,0 +1,69 @@
+package priam
+
+import (
+	"testing"
+)
+
+func TestPromoteToFull(t *testing.T) {
+	h := NewSnapshotHistory()
+	h.Add("base/ks/2026-03-01_000000/2026-03-01_000000/10.0.0.1/data/ks/t-1/mc-1-big-Data.db", 100)
+	h.Add("base/ks/2026-03-01_000000/2026-03-02_000000/10.0.0.1/data/ks/t-1/mc-2-big-Data.db", 30)
+	h.Add("base/ks/2026-03-02_000000/2026-03-03_000000/10.0.0.1/data/ks/t-1/mc-3-big-Data.db", 40)
+	tests := []struct {
+		name    string
+		config  Config
+		parent  string
+		promote bool
+	}{
+		{"no limits", Config{}, "2026-03-03_000000", false},
+		{"chain below limit", Config{MaxIncChain: 3}, "2026-03-03_000000", false},
+		{"chain at limit", Config{MaxIncChain: 2}, "2026-03-03_000000", true},
+		{"first incremental", Config{MaxIncChain: 1}, "2026-03-01_000000", false},
+		{"second incremental", Config{MaxIncChain: 1}, "2026-03-02_000000", true},
+		{"ratio below limit", Config{MaxIncRatio: 1}, "2026-03-03_000000", false},
+		{"ratio over limit", Config{MaxIncRatio: 0.5}, "2026-03-03_000000", true},
+		{"ratio of full parent", Config{MaxIncRatio: 0.01}, "2026-03-01_000000", false},
+		{"unknown parent", Config{}, "2026-03-04_000000", true},
+	}
+	for _, test := range tests {
+		config := test.config
+		p := &Priam{config: &config, hist: h}
+		if reason := p.promoteToFull(test.parent); (reason != "") != test.promote {
+			t.Errorf("%s: promoteToFull(%s) = %q, want promote %v", test.name, test.parent, reason, test.promote)
+		}
+	}
+}
+
+func TestRestoreKey(t *testing.T) {
+	key := "/base/ks/2026-03-01_000000/2026-03-01_000000/10.0.0.1/var/lib/cassandra/data/ks/t-1/mc-1-big-Data.db"
+	tests := []struct {
+		name   string
+		target string
+		key    string
+		want   string
+	}{
+		{
+			name: "same keyspace",
+			key:  key,
+			want: "base/ks/2026-03-01_000000/2026-03-01_000000/10.0.0.1/var/lib/cassandra/data/ks/t-1/mc-1-big-Data.db",
+		},
+		{
+			name:   "target keyspace",
+			target: "ks2",
+			key:    key,
+			want:   "base/ks/2026-03-01_000000/2026-03-01_000000/10.0.0.1/var/lib/cassandra/data/ks2/t-1/mc-1-big-Data.db",
+		},
+		{
+			name:   "short key",
+			target: "ks2",
+			key:    "base/ks/2026-03-01_000000/2026-03-01_000000/10.0.0.1/t-1/mc-1-big-Data.db",
+			want:   "base/ks/2026-03-01_000000/2026-03-01_000000/10.0.0.1/t-1/mc-1-big-Data.db",
+		},
+	}
+	for _, test := range tests {
+		p := &Priam{config: &Config{Keyspace: "ks", TargetKeyspace: test.target}}
+		if got := p.restoreKey(test.key); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package priam
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// refreshSnapshot restores snapshot by copying the files of every host
+// back to that same host and loading them there with nodetool refresh on
+// cassandra 3.x or nodetool import from 4.0, so no data is streamed
+// between nodes. The cluster must have the hosts the backup was taken on,
+// each still owning the tokens it owned then.
+func (p *Priam) refreshSnapshot(hosts []string, snapshot string) error {
+
+	// get list of keys to download
+	keys, err := p.restoreKeys(snapshot)
+	if err != nil {
+		return errors.Wrap(err, "failed to get all keys")
+	}
+
+	// keys of every host in the backup
+	live := make(map[string]bool)
+	for _, host := range hosts {
+		live[host] = true
+	}
+	hostKeys := make(map[string][]string)
+	for _, key := range keys {
+		host := keyParts(key)[4]
+		hostKeys[host] = append(hostKeys[host], key)
+	}
+	var backupHosts []string
+	for host := range hostKeys {
+		if !live[host] {
+			return fmt.Errorf("host %s of snapshot %s is not part of the cluster, use -loader sstableloader",
+				host, snapshot)
+		}
+		backupHosts = append(backupHosts, host)
+	}
+	sort.Strings(backupHosts)
+	if err := p.checkTokens(snapshot, backupHosts); err != nil {
+		return err
+	}
+
+	return parallel(p.config.Parallelism, backupHosts, func(host string) error {
+		if err := p.refreshHost(host, hostKeys[host]); err != nil {
+			return errors.Wrapf(err, "restore @ %s", host)
+		}
+		return nil
+	})
+}
+
+// checkTokens makes sure every host owns the same tokens as when each
+// snapshot restoring snapshot needs was taken, as files loaded in place
+// would otherwise end up on nodes not owning their data.
+func (p *Priam) checkTokens(snapshot string, hosts []string) error {
+	current := make(map[string][]string)
+	for _, host := range hosts {
+		tokens, err := p.cassandra.Tokens(host)
+		if err != nil {
+			return err
+		}
+		current[host] = tokens
+	}
+	return p.compareTokens(snapshot, hosts, current)
+}
+
+// compareTokens makes sure hosts own the same tokens in current as in
+// the manifest of every snapshot restoring snapshot needs.
+func (p *Priam) compareTokens(snapshot string, hosts []string, current map[string][]string) error {
+	chain, err := p.hist.Chain(snapshot)
+	if err != nil {
+		return err
+	}
+	owned := make(map[string]string)
+	for _, host := range hosts {
+		tokens := append([]string(nil), current[host]...)
+		sort.Strings(tokens)
+		owned[host] = strings.Join(tokens, ",")
+	}
+	for _, s := range chain {
+		m := p.hist.Manifest(s)
+		if m == nil {
+			return fmt.Errorf("snapshot %s has no manifest to check tokens against, use -loader sstableloader", s)
+		}
+		for _, host := range hosts {
+			tokens := append([]string(nil), m.Tokens[host]...)
+			sort.Strings(tokens)
+			if strings.Join(tokens, ",") != owned[host] {
+				return fmt.Errorf("tokens of host %s changed since snapshot %s, use -loader sstableloader",
+					host, s)
+			}
+		}
+	}
+	return nil
+}
+
+// refreshHost downloads keys backed up from host and loads them into
+// their tables on host.
+func (p *Priam) refreshHost(host string, keys []string) error {
+	localTmpDir := fmt.Sprintf("%s/local", p.config.TempDir)
+	remoteTmpDir := fmt.Sprintf("%s/remote", p.config.TempDir)
+
+	version, err := p.cassandra.Version(host)
+	if err != nil {
+		return err
+	}
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return errors.Wrapf(err, "unknown cassandra version %s", version)
+	}
+
+	if major < 4 && p.config.Mode == "additive" {
+		return fmt.Errorf("additive restore with refresh needs cassandra 4.0, %s runs %s, use -loader sstableloader",
+			host, version)
+	}
+
+	files, err := p.downloadKeys(keys, localTmpDir)
+	if err != nil {
+		return errors.Wrap(err, "error downloading keys")
+	}
+
+	// files of every table directory
+	tables := make(map[string]map[string]string)
+	for key, file := range files {
+		dir := path.Base(path.Dir(key))
+		if tables[dir] == nil {
+			tables[dir] = make(map[string]string)
+		}
+		tables[dir][key] = file
+	}
+
+	for dir, files := range tables {
+		table := tableName(dir)
+		keyspace := p.restoreKeyspace()
+		glog.Infof("loading %d files into %s.%s @ %s", len(files), keyspace, table, host)
+
+		// cassandra 4.0 imports sstables from any directory
+		if major >= 4 {
+			dirs, err := p.uploadFilesToHost(host, remoteTmpDir, files)
+			if err != nil {
+				return errors.Wrap(err, "could not upload files to host")
+			}
+			for dir := range dirs {
+				if err = p.cassandra.Import(host, keyspace, table, dir); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// older versions pick them up from the live table directory
+		tableDir, err := p.cassandra.TableDir(host, keyspace, table)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err = p.agent.UploadFile(host, file, tableDir); err != nil {
+				return errors.Wrap(err, "error uploading backup files to host")
+			}
+		}
+		if err = p.cassandra.Refresh(host, keyspace, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
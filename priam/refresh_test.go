@@ -0,0 +1,48 @@
+package priam
+
+import (
+	"testing"
+)
+
+func TestCompareTokens(t *testing.T) {
+	hosts := []string{"10.0.0.1", "10.0.0.2"}
+	current := map[string][]string{
+		"10.0.0.1": {"300", "100"},
+		"10.0.0.2": {"200", "400"},
+	}
+	tests := []struct {
+		name     string
+		snapshot string
+		err      bool
+	}{
+		{"same tokens in any order", "2026-03-09_000000", false},
+		{"tokens moved since parent", "2026-03-07_000000", true},
+		{"no manifest", "2026-03-02_000000", true},
+		{"unknown snapshot", "2026-03-08_000000", true},
+	}
+
+	// 2026-03-07 matches the current tokens, but its parent 2026-03-06
+	// was taken on top of 2026-03-05, from before the tokens moved
+	h := testHistory()
+	h.AddManifest(&Manifest{
+		Timestamp: "2026-03-05_000000",
+		Tokens:    map[string][]string{"10.0.0.1": {"100", "200"}, "10.0.0.2": {"300", "400"}},
+	})
+	for _, timestamp := range []string{"2026-03-06_000000", "2026-03-07_000000", "2026-03-09_000000"} {
+		m := &Manifest{
+			Timestamp: timestamp,
+			Tokens:    map[string][]string{"10.0.0.1": {"100", "300"}, "10.0.0.2": {"400", "200"}},
+		}
+		if testSnapshots[timestamp] != timestamp {
+			m.Parent = testSnapshots[timestamp]
+		}
+		h.AddManifest(m)
+	}
+	p := &Priam{config: &Config{}, hist: h}
+	for _, test := range tests {
+		err := p.compareTokens(test.snapshot, hosts, current)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package priam
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timestampFormat is the format of snapshot timestamps.
+const timestampFormat = "2006-01-02_150405"
+
+// Prune deletes snapshots that are not kept by the retention policy. A
+// snapshot is kept if any of the configured rules keeps it, and every
+// parent of a kept incremental snapshot is kept too. The latest snapshot
+// is always kept.
+func (p *Priam) Prune() error {
+
+	// get snapshot history
+	if err := p.SnapshotHistory(); err != nil {
+		return errors.Wrap(err, "error getting snapshot history")
+	}
+	snapshots := p.hist.List()
+	if len(snapshots) == 0 {
+		fmt.Printf("no backups to prune\n")
+		return nil
+	}
+
+	keep, err := p.retained(snapshots, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// delete newest first so an interrupted prune never leaves an
+	// incremental snapshot without its parent
+	var remove []string
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !keep[snapshots[i]] {
+			remove = append(remove, snapshots[i])
+		}
+	}
+	if len(remove) == 0 {
+		fmt.Printf("nothing to prune, keeping %d backups\n", len(snapshots))
+		return nil
+	}
+
+	if err := p.removeSnapshots(remove); err != nil {
+		return err
+	}
+	fmt.Printf("kept %d backups, removed %d\n",
+		len(snapshots)-len(remove), len(remove))
+	return nil
+}
+
+// retained returns the set of snapshots kept by the retention policy.
+func (p *Priam) retained(snapshots []string, now time.Time) (map[string]bool, error) {
+	c := p.config
+	if c.KeepLast == 0 && c.KeepDaily == 0 && c.KeepWeekly == 0 && c.MaxAge == "" {
+		return nil, fmt.Errorf("no retention policy configured (keep-last, keep-daily, keep-weekly, max-age)")
+	}
+
+	keep := make(map[string]bool)
+	keep[snapshots[len(snapshots)-1]] = true
+
+	// keep the last N full snapshots and incrementals built on them
+	if c.KeepLast > 0 {
+		var fulls []string
+		for _, snapshot := range snapshots {
+			if p.hist.IsFull(snapshot) {
+				fulls = append(fulls, snapshot)
+			}
+		}
+		if len(fulls) > c.KeepLast {
+			fulls = fulls[len(fulls)-c.KeepLast:]
+		}
+		kept := make(map[string]bool)
+		for _, full := range fulls {
+			kept[full] = true
+		}
+		for _, snapshot := range snapshots {
+			if kept[p.hist.Root(snapshot)] {
+				keep[snapshot] = true
+			}
+		}
+	}
+
+	// keep the latest snapshot of each of the last days and weeks
+	if c.KeepDaily > 0 {
+		since := now.AddDate(0, 0, -c.KeepDaily)
+		keepPeriods(keep, snapshots, since, func(t time.Time) string {
+			return t.Format("2006-01-02")
+		})
+	}
+	if c.KeepWeekly > 0 {
+		since := now.AddDate(0, 0, -7*c.KeepWeekly)
+		keepPeriods(keep, snapshots, since, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		})
+	}
+
+	// keep everything younger than max age
+	if c.MaxAge != "" {
+		maxAge, err := parseAge(c.MaxAge)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid max-age")
+		}
+		since := now.Add(-maxAge)
+		for _, snapshot := range snapshots {
+			t, err := parseTimestamp(snapshot)
+			if err != nil || t.After(since) {
+				keep[snapshot] = true
+			}
+		}
+	}
+
+	// keep parents of everything kept
+	var kept []string
+	for snapshot := range keep {
+		kept = append(kept, snapshot)
+	}
+	for _, snapshot := range kept {
+		chain, err := p.hist.Chain(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range chain {
+			keep[s] = true
+		}
+	}
+	return keep, nil
+}
+
+// keepPeriods marks the latest snapshot of every period after since as
+// kept, where period returns the name of the period a time falls in.
+func keepPeriods(keep map[string]bool, snapshots []string, since time.Time,
+	period func(time.Time) string) {
+	latest := make(map[string]string)
+	for _, snapshot := range snapshots {
+		t, err := parseTimestamp(snapshot)
+		if err != nil {
+			keep[snapshot] = true
+			continue
+		}
+		if t.Before(since) {
+			continue
+		}
+		// snapshots are ordered, so the last one seen is the latest
+		latest[period(t)] = snapshot
+	}
+	for _, snapshot := range latest {
+		keep[snapshot] = true
+	}
+}
+
+// removeSnapshots deletes snapshots in the given order, followed by the
+// blobs and commitlogs only they needed. With dry-run the snapshots are
+// only printed.
+func (p *Priam) removeSnapshots(snapshots []string) error {
+	for _, snapshot := range snapshots {
+		if p.config.DryRun {
+			fmt.Printf("would remove %s (%d objects)\n",
+				snapshot, len(p.hist.Objects(snapshot)))
+			continue
+		}
+		fmt.Printf("removing %s (%d objects)\n",
+			snapshot, len(p.hist.Objects(snapshot)))
+		if err := p.removeSnapshot(snapshot); err != nil {
+			return errors.Wrapf(err, "error removing snapshot %s", snapshot)
+		}
+	}
+	if err := p.removeBlobs(snapshots); err != nil {
+		return errors.Wrap(err, "error removing blobs")
+	}
+	if err := p.removeCommitlogs(snapshots); err != nil {
+		return errors.Wrap(err, "error removing commitlogs")
+	}
+	return nil
+}
+
+// removeSnapshot deletes every object of a snapshot from storage. The
+// manifest goes first so no manifest ever refers to deleted objects.
+func (p *Priam) removeSnapshot(snapshot string) error {
+	var manifest, keys []string
+	for _, key := range p.hist.Objects(snapshot) {
+		if strings.HasSuffix(key, "/"+manifestName) {
+			manifest = append(manifest, key)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	if err := p.deleteKeys(manifest); err != nil {
+		return err
+	}
+	return p.deleteKeys(keys)
+}
+
+// deleteKeys removes keys from storage, in batches if the backend
+// supports it.
+func (p *Priam) deleteKeys(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if b, ok := p.storage.(BatchDeleter); ok {
+		return b.DeleteKeys(keys)
+	}
+	return parallel(p.config.DownloadWorkers, keys, func(key string) error {
+		return p.storage.Delete(key)
+	})
+}
+
+// parseTimestamp parses a snapshot timestamp in local time.
+func parseTimestamp(timestamp string) (time.Time, error) {
+	return time.ParseInLocation(timestampFormat, timestamp, time.Local)
+}
+
+// parseAge parses a duration that may also be given in days, such as
+// "30d".
+func parseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(age)
+}
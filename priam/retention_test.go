@@ -0,0 +1,174 @@
+package priam
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSnapshots are the snapshots of testHistory by their parent, which
+// is the snapshot itself for full snapshots.
+var testSnapshots = map[string]string{
+	"2026-03-01_000000": "2026-03-01_000000",
+	"2026-03-02_000000": "2026-03-01_000000",
+	"2026-03-05_000000": "2026-03-05_000000",
+	"2026-03-06_000000": "2026-03-05_000000",
+	"2026-03-07_000000": "2026-03-06_000000",
+	"2026-03-09_000000": "2026-03-09_000000",
+}
+
+// testHistory returns a history of testSnapshots, each holding a single
+// data file.
+func testHistory() *SnapshotHistory {
+	h := NewSnapshotHistory()
+	for timestamp, parent := range testSnapshots {
+		h.Add(fmt.Sprintf("base/ks/%s/%s/10.0.0.1/data/ks/t-1/mc-1-big-Data.db",
+			parent, timestamp), 1)
+	}
+	return h
+}
+
+func TestRetained(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name   string
+		config Config
+		keep   []string
+		err    bool
+	}{
+		{
+			name: "no policy",
+			err:  true,
+		},
+		{
+			name:   "keep last full",
+			config: Config{KeepLast: 1},
+			keep:   []string{"2026-03-09_000000"},
+		},
+		{
+			name:   "keep last two fulls with incrementals",
+			config: Config{KeepLast: 2},
+			keep:   []string{"2026-03-05_000000", "2026-03-06_000000", "2026-03-07_000000", "2026-03-09_000000"},
+		},
+		{
+			name:   "keep daily with parents",
+			config: Config{KeepDaily: 4},
+			keep:   []string{"2026-03-05_000000", "2026-03-06_000000", "2026-03-07_000000", "2026-03-09_000000"},
+		},
+		{
+			name:   "keep daily keeps latest",
+			config: Config{KeepDaily: 1},
+			keep:   []string{"2026-03-09_000000"},
+		},
+		{
+			name:   "keep weekly",
+			config: Config{KeepWeekly: 2},
+			keep:   []string{"2026-03-01_000000", "2026-03-05_000000", "2026-03-06_000000", "2026-03-07_000000", "2026-03-09_000000"},
+		},
+		{
+			name:   "max age in days",
+			config: Config{MaxAge: "5d"},
+			keep:   []string{"2026-03-05_000000", "2026-03-06_000000", "2026-03-07_000000", "2026-03-09_000000"},
+		},
+		{
+			name:   "invalid max age",
+			config: Config{MaxAge: "5x"},
+			err:    true,
+		},
+	}
+	for _, test := range tests {
+		config := test.config
+		p := &Priam{config: &config, hist: testHistory()}
+		keep, err := p.retained(p.hist.List(), now)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		var kept []string
+		for snapshot := range keep {
+			kept = append(kept, snapshot)
+		}
+		sort.Strings(kept)
+		if !reflect.DeepEqual(kept, test.keep) {
+			t.Errorf("%s: kept %v, want %v", test.name, kept, test.keep)
+		}
+	}
+}
+
+func TestRetainedCycle(t *testing.T) {
+	h := NewSnapshotHistory()
+	h.Add("base/ks/2026-03-02_000000/2026-03-01_000000/10.0.0.1/data/ks/t-1/mc-1-big-Data.db", 1)
+	h.Add("base/ks/2026-03-01_000000/2026-03-02_000000/10.0.0.1/data/ks/t-1/mc-1-big-Data.db", 1)
+	p := &Priam{config: &Config{KeepLast: 1}, hist: h}
+	if _, err := p.retained(h.List(), time.Now()); err == nil {
+		t.Errorf("retained with a cycle of parents did not fail")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+		keep   []string
+	}{
+		{
+			name: "prune",
+			keep: []string{"2026-03-05_000000", "2026-03-06_000000", "2026-03-07_000000", "2026-03-09_000000"},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+			keep:   []string{"2026-03-01_000000", "2026-03-02_000000", "2026-03-05_000000", "2026-03-06_000000", "2026-03-07_000000", "2026-03-09_000000"},
+		},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "priam")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		p := testStorage(t, dir)
+		p.config.KeepLast = 2
+		p.config.DryRun = test.dryRun
+		if err := p.Prune(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if kept := storedSnapshots(t, p); !reflect.DeepEqual(kept, test.keep) {
+			t.Errorf("%s: kept %v, want %v", test.name, kept, test.keep)
+		}
+	}
+}
+
+// testStorage returns a Priam with local storage in dir holding the
+// snapshots of testHistory.
+func testStorage(t *testing.T, dir string) *Priam {
+	config := &Config{
+		AwsBasePath:     "base",
+		Keyspace:        "ks",
+		StoragePath:     dir,
+		DownloadWorkers: 2,
+	}
+	p := &Priam{config: config, storage: NewLocal(config)}
+	for timestamp, parent := range testSnapshots {
+		key := fmt.Sprintf("base/ks/%s/%s/10.0.0.1/data/ks/t-1/mc-1-big-Data.db", parent, timestamp)
+		if err := p.storage.Put(key, strings.NewReader("data"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// storedSnapshots returns the snapshots left in the storage of p.
+func storedSnapshots(t *testing.T, p *Priam) []string {
+	p.hist = nil
+	if err := p.SnapshotHistory(); err != nil {
+		t.Fatal(err)
+	}
+	return p.hist.List()
+}
@@ -1,198 +1,469 @@
 package priam
 
 import (
-	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"io"
-	"os"
-	"path"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"strings"
 )
 
 // S3 object interfaces with AWS S3.
 type S3 struct {
-	config   *Config
-	agent    *Agent
-	svc      *s3.S3
-	uploader *s3manager.Uploader
+	config         *Config
+	svc            *s3.S3
+	uploader       *s3manager.Uploader
+	sseCustomerKey string // raw SSE-C key, empty if not used
+	tagging        string // url encoded object tags
 }
 
-// NewS3 creates a new S3 object to interface with AWS S3.
-func NewS3(config *Config, agent *Agent) *S3 {
+// NewS3 creates a new S3 object to interface with AWS S3 or any S3
+// compatible service such as MinIO or Ceph RGW.
+//
+// Static keys are used when aws-access-key and aws-secret-key are given,
+// otherwise credentials come from the standard AWS chain: environment
+// variables, shared config and credentials files (see aws-profile), web
+// identity tokens and EC2/ECS instance roles. If aws-role-arn is set the
+// resulting credentials are used to assume that role.
+func NewS3(config *Config) (*S3, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(config.AwsRegion),
+	}
+	if config.AwsAccessKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(
+			config.AwsAccessKey, config.AwsSecretKey, "")
+	}
+
+	// custom endpoint for S3 compatible services
+	if config.AwsEndpoint != "" {
+		awsConfig.Endpoint = aws.String(config.AwsEndpoint)
+	}
+	if config.AwsPathStyle {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	// custom TLS settings
+	if config.AwsCACert != "" || config.AwsInsecureTLS {
+		client, err := s3HTTPClient(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "error setting up TLS for S3")
+		}
+		awsConfig.HTTPClient = client
+	}
+
 	// create new session
-	sess := session.New(&aws.Config{
-		Region:      aws.String(config.AwsRegion),
-		Credentials: credentials.NewStaticCredentials(config.AwsAccessKey, config.AwsSecretKey, ""),
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		Profile:           config.AwsProfile,
+		SharedConfigState: session.SharedConfigEnable,
 	})
-	return &S3{
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating AWS session")
+	}
+
+	// assume role if requested
+	if config.AwsRoleArn != "" {
+		creds := stscreds.NewCredentials(sess, config.AwsRoleArn,
+			func(p *stscreds.AssumeRoleProvider) {
+				if config.AwsExternalID != "" {
+					p.ExternalID = aws.String(config.AwsExternalID)
+				}
+			})
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+
+	s := &S3{
 		config:   config,
-		agent:    agent,
 		svc:      s3.New(sess),
 		uploader: s3manager.NewUploader(sess),
 	}
-}
 
-// UploadFiles uploads a list of files to AWS S3.
-func (s *S3) UploadFiles(parent, timestamp, host string, files []string) error {
-	glog.Infof("uploading files to s3...")
-	for _, file := range files {
-		key := s.getFileKey(parent, timestamp, host, file)
-		if err := s.UploadFile(host, file, key); err != nil {
-			return err
+	// customer provided encryption key
+	if config.AwsSSE == "customer" {
+		key, err := readKeyFile(config.AwsSSECustomerKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading SSE-C key")
 		}
+		s.sseCustomerKey = string(key)
 	}
-	return nil
+
+	// object tags
+	if s.tagging, err = parseTags(config.AwsTags); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-// UploadFile uploads a file to AWS S3.
-func (s *S3) UploadFile(host, file, key string) error {
-	glog.Infof("upload key: %s", key)
+// parseTags converts tags of the form "key=value,key=value" into the url
+// encoded form expected by S3.
+func parseTags(tags string) (string, error) {
+	values := url.Values{}
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return "", fmt.Errorf("invalid tag '%s', expected key=value", tag)
+		}
+		values.Add(kv[0], kv[1])
+	}
+	return values.Encode(), nil
+}
 
-	// read bytes from file@host
-	r, err := s.agent.ReadFile(host, file)
-	if err != nil {
-		return errors.Wrapf(err, "error reading %s:%s", host, file)
+// s3HTTPClient returns an http client that trusts the CA certificate
+// given by aws-ca-cert and skips certificate verification if
+// aws-insecure-tls is set.
+func s3HTTPClient(config *Config) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.AwsInsecureTLS,
+	}
+	if config.AwsCACert != "" {
+		pem, err := ioutil.ReadFile(config.AwsCACert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading CA cert %s", config.AwsCACert)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.AwsCACert)
+		}
+		tlsConfig.RootCAs = pool
 	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
 
-	// gzip files before uploading
-	reader, writer := io.Pipe()
-	go func() {
-		gw := gzip.NewWriter(writer)
-		io.Copy(gw, r)
-		gw.Close()
-		writer.Close()
-	}()
+// Put uploads everything read from r to AWS S3 under key. Metadata is
+// stored as S3 user metadata.
+func (s *S3) Put(key string, r io.Reader, meta map[string]string) error {
 
 	// details of file to upload
 	params := &s3manager.UploadInput{
 		Bucket: aws.String(s.config.AwsBucket),
-		Body:   reader,
+		Body:   r,
 		Key:    aws.String(key),
 	}
+	if len(meta) > 0 {
+		params.Metadata = aws.StringMap(meta)
+	}
+
+	// encryption, storage class and tags
+	o := s.objectOptions(key)
+	params.ServerSideEncryption = o.ServerSideEncryption
+	params.SSEKMSKeyId = o.SSEKMSKeyId
+	params.SSECustomerAlgorithm = o.SSECustomerAlgorithm
+	params.SSECustomerKey = o.SSECustomerKey
+	params.StorageClass = o.StorageClass
+	params.Tagging = o.Tagging
 
 	// upload file
-	_, err = s.uploader.Upload(params, func(u *s3manager.Uploader) {
+	_, err := s.uploader.Upload(params, func(u *s3manager.Uploader) {
 		u.MaxUploadParts = 10000       // set to maximum allowed by s3
 		u.PartSize = 128 * 1024 * 1024 // 128MB
 	})
 	if err != nil {
-		return errors.Wrapf(err, "error uploading %s:%s", host, file)
+		return errors.Wrapf(err, "error uploading key %s", key)
 	}
 	return nil
 }
 
-// getFileKey creates a unique key for backup file that would be uploaded
-// to AWS S3.
-func (s *S3) getFileKey(parent, timestamp, host, file string) string {
-	dir, base := path.Split(path.Clean(file))
-	dir, _ = path.Split(path.Clean(dir))
-	if !s.config.Incremental {
-		dir, _ = path.Split(path.Clean(dir))
-	}
-	return fmt.Sprintf("/%s/%s/%s/%s/%s%s%s.gz",
-		s.config.AwsBasePath, s.config.Keyspace, parent,
-		timestamp, host, dir, base)
+// objectOptions holds the encryption, storage class and tags of a new
+// object, ready to be set on any request creating one. Unused settings
+// are nil.
+type objectOptions struct {
+	ServerSideEncryption *string
+	SSEKMSKeyId          *string
+	SSECustomerAlgorithm *string
+	SSECustomerKey       *string
+	StorageClass         *string
+	Tagging              *string
 }
 
-// downloadKeys downloads a list of keys from S3 to local machine.
-func (s *S3) downloadKeys(keys []string, prefix string) (map[string]string, error) {
-	glog.Infof("downloading %d keys", len(keys))
-	files := make(map[string]string)
-	for _, key := range keys {
-		file, err := s.downloadKey(key, prefix)
-		if err != nil {
-			return nil, errors.Wrapf(err, "error downloading %s", key)
+// objectOptions returns the settings for a new object under key as
+// given by the configuration.
+func (s *S3) objectOptions(key string) *objectOptions {
+	o := &objectOptions{}
+	switch s.config.AwsSSE {
+	case "s3":
+		o.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+	case "kms":
+		o.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		if s.config.AwsSSEKMSKeyID != "" {
+			o.SSEKMSKeyId = aws.String(s.config.AwsSSEKMSKeyID)
 		}
-		files[key] = file
+	case "customer":
+		o.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		o.SSECustomerKey = aws.String(s.sseCustomerKey)
 	}
-	return files, nil
+	if class := s.storageClass(key); class != "" {
+		o.StorageClass = aws.String(class)
+	}
+	if s.tagging != "" {
+		o.Tagging = aws.String(s.tagging)
+	}
+	return o
 }
 
-func (s *S3) downloadKey(key, prefix string) (string, error) {
-	glog.V(2).Infof("download key: %s", key)
-	fileName := strings.TrimSuffix(fmt.Sprintf("%s/%s", prefix, key), ".gz")
+// storageClass returns the storage class to store key with. Manifests,
+// schemas and cluster schema artifacts are always kept in STANDARD as
+// every command reads them through the snapshot history. Data files,
+// blobs and commitlogs get aws-storage-class.
+func (s *S3) storageClass(key string) string {
+	if s.config.AwsStorageClass == "" || isMetadataKey(key) {
+		return ""
+	}
+	return s.config.AwsStorageClass
+}
+
+// Get returns the contents and metadata of key stored in AWS S3.
+func (s *S3) Get(key string) (io.ReadCloser, map[string]string, error) {
 	params := &s3.GetObjectInput{
 		Bucket: aws.String(s.config.AwsBucket),
 		Key:    aws.String(key),
 	}
+	if s.sseCustomerKey != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = aws.String(s.sseCustomerKey)
+	}
 	resp, err := s.svc.GetObject(params)
 	if err != nil {
-		return "", errors.Wrapf(err, "error downloading key: %s", key)
+		return nil, nil, errors.Wrapf(err, "error downloading key: %s", key)
 	}
+	return resp.Body, s3Metadata(resp.Metadata), nil
+}
 
-	dir := path.Dir(fileName)
-	err = os.MkdirAll(dir, os.ModeDir|os.ModePerm)
-	if err != nil {
-		return "", errors.Wrapf(err, "error creading dir %s", dir)
+// List returns all objects in AWS S3 with the given prefix.
+func (s *S3) List(prefix string) ([]*ObjectInfo, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.config.AwsBucket),
+		Prefix: aws.String(prefix),
+	}
+	var objects []*ObjectInfo
+	for {
+		resp, err := s.svc.ListObjectsV2(params)
+		if err != nil {
+			return nil, errors.Wrap(err, "error listing from S3")
+		}
+		for _, obj := range resp.Contents {
+			objects = append(objects, &ObjectInfo{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		params.ContinuationToken = resp.NextContinuationToken
 	}
+	return objects, nil
+}
 
-	file, err := os.Create(fileName)
-	if err != nil {
-		return "", errors.Wrap(err, "error opening file")
+// Delete removes key from AWS S3.
+func (s *S3) Delete(key string) error {
+	glog.V(2).Infof("delete key: %s", key)
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.config.AwsBucket),
+		Key:    aws.String(key),
+	}
+	if _, err := s.svc.DeleteObject(params); err != nil {
+		return errors.Wrapf(err, "error deleting key: %s", key)
 	}
+	return nil
+}
 
-	reader, writer := io.Pipe()
-	go func() {
-		gr, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			glog.Errorf("error creating new gzip reader")
-			os.Exit(1)
-		}
-		io.Copy(writer, gr)
-		gr.Close()
-		writer.Close()
-	}()
+// deleteBatchSize is the maximum number of keys S3 deletes per request.
+const deleteBatchSize = 1000
 
-	buf := make([]byte, 1024)
-	for {
-		n, err := reader.Read(buf)
-		if err != nil && err != io.EOF {
-			return "", errors.Wrap(err, "error reading file")
+// DeleteKeys removes keys from AWS S3 using batched DeleteObjects calls.
+func (s *S3) DeleteKeys(keys []string) error {
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
 		}
-		if n == 0 {
-			break
+		var objects []*s3.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			glog.V(2).Infof("delete key: %s", key)
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		params := &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.config.AwsBucket),
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		}
+		resp, err := s.svc.DeleteObjects(params)
+		if err != nil {
+			return errors.Wrap(err, "error deleting keys")
 		}
-		if _, writeErr := file.Write(buf[:n]); writeErr != nil {
-			return "", errors.Wrap(err, "error writing file")
+		if len(resp.Errors) > 0 {
+			e := resp.Errors[0]
+			return fmt.Errorf("error deleting %d keys, first %s: %s",
+				len(resp.Errors), aws.StringValue(e.Key), aws.StringValue(e.Message))
 		}
 	}
+	return nil
+}
+
+// copyPartSize is the size of each part when copying objects too large
+// for a single CopyObject call.
+const copyPartSize = 512 * 1024 * 1024
+
+// copyObjectMaxSize is the largest object S3 copies in a single call.
+const copyObjectMaxSize = 5 * 1024 * 1024 * 1024
+
+// Copy copies src to dst within the bucket using server side copy, so no
+// data passes through this host. Metadata is kept while encryption,
+// storage class and tags of the copy follow the configuration. Objects
+// over 5GB are copied in parts.
+func (s *S3) Copy(src, dst string) error {
+	glog.V(2).Infof("copy key: %s -> %s", src, dst)
+	info, err := s.Stat(src)
+	if err != nil {
+		return err
+	}
+	source := url.PathEscape(s.config.AwsBucket + "/" + strings.TrimPrefix(src, "/"))
+	if info.Size > copyObjectMaxSize {
+		return s.copyParts(source, dst, info)
+	}
 
-	if err = reader.Close(); err != nil {
-		return "", errors.Wrap(err, "error closing reader")
+	params := &s3.CopyObjectInput{
+		Bucket:     aws.String(s.config.AwsBucket),
+		CopySource: aws.String(source),
+		Key:        aws.String(dst),
 	}
-	if err = file.Close(); err != nil {
-		return "", errors.Wrap(err, "error closing file")
+	o := s.objectOptions(dst)
+	params.ServerSideEncryption = o.ServerSideEncryption
+	params.SSEKMSKeyId = o.SSEKMSKeyId
+	params.SSECustomerAlgorithm = o.SSECustomerAlgorithm
+	params.SSECustomerKey = o.SSECustomerKey
+	params.CopySourceSSECustomerAlgorithm = o.SSECustomerAlgorithm
+	params.CopySourceSSECustomerKey = o.SSECustomerKey
+	params.StorageClass = o.StorageClass
+	if _, err = s.svc.CopyObject(params); err != nil {
+		return errors.Wrapf(err, "error copying key %s to %s", src, dst)
 	}
-	return fileName, nil
+	return nil
 }
 
-// SnapshotHistory retrieves snapshot history from S3.
-func (s *S3) SnapshotHistory() (*SnapshotHistory, error) {
-	prefix := fmt.Sprintf("%s/%s", s.config.AwsBasePath, s.config.Keyspace)
-	params := &s3.ListObjectsV2Input{
-		Bucket: aws.String(s.config.AwsBucket),
-		Prefix: aws.String(prefix),
+// copyParts copies a large object with a multipart upload whose parts
+// are copied server side from source.
+func (s *S3) copyParts(source, dst string, info *ObjectInfo) error {
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.config.AwsBucket),
+		Key:      aws.String(dst),
+		Metadata: aws.StringMap(info.Metadata),
 	}
-	h := NewSnapshotHistory()
-	for {
-		resp, err := s.svc.ListObjectsV2(params)
-		if err != nil {
-			return nil, errors.Wrap(err, "error listing from S3")
+	o := s.objectOptions(dst)
+	create.ServerSideEncryption = o.ServerSideEncryption
+	create.SSEKMSKeyId = o.SSEKMSKeyId
+	create.SSECustomerAlgorithm = o.SSECustomerAlgorithm
+	create.SSECustomerKey = o.SSECustomerKey
+	create.StorageClass = o.StorageClass
+	create.Tagging = o.Tagging
+	upload, err := s.svc.CreateMultipartUpload(create)
+	if err != nil {
+		return errors.Wrapf(err, "error starting copy to %s", dst)
+	}
+
+	// do not leave billed parts behind if the copy fails
+	abort := func() {
+		s.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.config.AwsBucket),
+			Key:      aws.String(dst),
+			UploadId: upload.UploadId,
+		})
+	}
+
+	var parts []*s3.CompletedPart
+	for start := int64(0); start < info.Size; start += copyPartSize {
+		end := start + copyPartSize - 1
+		if end >= info.Size {
+			end = info.Size - 1
 		}
-		for _, obj := range resp.Contents {
-			h.Add(*obj.Key)
+		number := int64(len(parts) + 1)
+		params := &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.config.AwsBucket),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			Key:             aws.String(dst),
+			PartNumber:      aws.Int64(number),
+			UploadId:        upload.UploadId,
 		}
-		if !*resp.IsTruncated {
-			break
+		params.SSECustomerAlgorithm = o.SSECustomerAlgorithm
+		params.SSECustomerKey = o.SSECustomerKey
+		params.CopySourceSSECustomerAlgorithm = o.SSECustomerAlgorithm
+		params.CopySourceSSECustomerKey = o.SSECustomerKey
+		resp, err := s.svc.UploadPartCopy(params)
+		if err != nil {
+			abort()
+			return errors.Wrapf(err, "error copying part %d to %s", number, dst)
 		}
-		params.ContinuationToken = resp.NextContinuationToken
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       resp.CopyPartResult.ETag,
+			PartNumber: aws.Int64(number),
+		})
+	}
+
+	_, err = s.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.config.AwsBucket),
+		Key:             aws.String(dst),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		abort()
+		return errors.Wrapf(err, "error completing copy to %s", dst)
+	}
+	return nil
+}
+
+// Stat returns size and modification time of key in AWS S3.
+func (s *S3) Stat(key string) (*ObjectInfo, error) {
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.AwsBucket),
+		Key:    aws.String(key),
+	}
+	if s.sseCustomerKey != "" {
+		params.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		params.SSECustomerKey = aws.String(s.sseCustomerKey)
+	}
+	resp, err := s.svc.HeadObject(params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting info for key: %s", key)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(resp.ContentLength),
+		LastModified: aws.TimeValue(resp.LastModified),
+		Metadata:     s3Metadata(resp.Metadata),
+	}, nil
+}
+
+// s3Metadata converts S3 user metadata, which comes back with canonical
+// header casing, to a map with lower case keys.
+func s3Metadata(metadata map[string]*string) map[string]string {
+	meta := make(map[string]string)
+	for k, v := range metadata {
+		meta[strings.ToLower(k)] = aws.StringValue(v)
 	}
-	return h, nil
+	return meta
 }
@@ -0,0 +1,87 @@
+package priam
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		tags string
+		want string
+		err  bool
+	}{
+		{"", "", false},
+		{"team=db", "team=db", false},
+		{" team=db , env=prod ,", "env=prod&team=db", false},
+		{"note=a b&c", "note=a+b%26c", false},
+		{"empty=", "empty=", false},
+		{"team", "", true},
+		{"=db", "", true},
+	}
+	for _, test := range tests {
+		got, err := parseTags(test.tags)
+		if (err != nil) != test.err {
+			t.Errorf("parseTags(%q) error %v, want error %v", test.tags, err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseTags(%q) = %q, want %q", test.tags, got, test.want)
+		}
+	}
+}
+
+func TestObjectOptions(t *testing.T) {
+	data := "base/ks/2026-03-01_000000/2026-03-01_000000/10.0.0.1/data/ks/t-1/mc-1-big-Data.db.gz"
+	tests := []struct {
+		name     string
+		config   Config
+		key      string
+		sse      string
+		kmsKeyID string
+		customer bool
+		class    string
+		tagging  string
+		tagged   bool
+	}{
+		{name: "defaults", key: data},
+		{name: "s3 managed keys", config: Config{AwsSSE: "s3"}, key: data, sse: "AES256"},
+		{name: "kms default key", config: Config{AwsSSE: "kms"}, key: data, sse: "aws:kms"},
+		{name: "kms key", config: Config{AwsSSE: "kms", AwsSSEKMSKeyID: "alias/backup"}, key: data,
+			sse: "aws:kms", kmsKeyID: "alias/backup"},
+		{name: "customer key", config: Config{AwsSSE: "customer"}, key: data, customer: true},
+		{name: "data storage class", config: Config{AwsStorageClass: "GLACIER_IR"}, key: data,
+			class: "GLACIER_IR"},
+		{name: "blob storage class", config: Config{AwsStorageClass: "GLACIER_IR"},
+			key: "base/ks/blobs/0123abcd.gz", class: "GLACIER_IR"},
+		{name: "commitlog storage class", config: Config{AwsStorageClass: "GLACIER_IR"},
+			key: "base/commitlogs/10.0.0.1/CommitLog-7-1.log.gz", class: "GLACIER_IR"},
+		{name: "manifest stays standard", config: Config{AwsStorageClass: "DEEP_ARCHIVE"},
+			key: "backups/prod/ks/2026-03-01_000000/2026-03-01_000000/manifest.json"},
+		{name: "schema stays standard", config: Config{AwsStorageClass: "DEEP_ARCHIVE"},
+			key: "backups/prod/ks/2026-03-01_000000/2026-03-01_000000/ks.schema.zst"},
+		{name: "cluster schema stays standard", config: Config{AwsStorageClass: "DEEP_ARCHIVE"},
+			key: "base/ks/2026-03-01_000000/2026-03-01_000000/auth.cql.gz"},
+		{name: "tags", key: data, tagging: "team=db", tagged: true},
+	}
+	for _, test := range tests {
+		config := test.config
+		s := &S3{config: &config, sseCustomerKey: "secret", tagging: test.tagging}
+		o := s.objectOptions(test.key)
+		if got := aws.StringValue(o.ServerSideEncryption); got != test.sse {
+			t.Errorf("%s: server side encryption %q, want %q", test.name, got, test.sse)
+		}
+		if got := aws.StringValue(o.SSEKMSKeyId); got != test.kmsKeyID {
+			t.Errorf("%s: kms key %q, want %q", test.name, got, test.kmsKeyID)
+		}
+		if got := o.SSECustomerKey != nil; got != test.customer {
+			t.Errorf("%s: customer key set %v, want %v", test.name, got, test.customer)
+		}
+		if got := aws.StringValue(o.StorageClass); got != test.class {
+			t.Errorf("%s: storage class %q, want %q", test.name, got, test.class)
+		}
+		if got := o.Tagging != nil; got != test.tagged {
+			t.Errorf("%s: tagging set %v, want %v", test.name, got, test.tagged)
+		}
+	}
+}
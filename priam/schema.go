@@ -0,0 +1,221 @@
+package priam
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// createTablePattern matches a CREATE TABLE statement up to its WITH
+// clause, capturing the table name and its column definitions.
+var createTablePattern = regexp.MustCompile(
+	`(?s)CREATE TABLE (?:IF NOT EXISTS )?(?:"?\w+"?\.)?"?(\w+)"?\s*\((.*?)\)\s*WITH `)
+
+// prepareSchema adjusts the schema in localFile for the restore at hand
+// and returns the file holding the schema to create, which is localFile
+// itself if nothing needs to change.
+func (p *Priam) prepareSchema(localFile, snapshot string) (string, error) {
+	target := p.restoreKeyspace()
+	keep := p.partialRestore(snapshot) || p.config.Mode == "additive"
+	if p.config.RestoreTime == "" && target == p.config.Keyspace && !keep {
+		return localFile, nil
+	}
+	data, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading schema %s", localFile)
+	}
+	schema := string(data)
+
+	// commitlogs only replay into tables with their original id
+	if p.config.RestoreTime != "" {
+		if schema, err = p.withTableIDs(schema, snapshot); err != nil {
+			return "", err
+		}
+	}
+
+	// restore into another keyspace
+	if target != p.config.Keyspace {
+		schema = withKeyspace(schema, p.config.Keyspace, target)
+	}
+
+	// keep existing tables
+	if keep {
+		schema = withIfNotExists(schema)
+	}
+
+	restoreFile := localFile + ".restore"
+	if err = ioutil.WriteFile(restoreFile, []byte(schema), 0644); err != nil {
+		return "", errors.Wrapf(err, "error writing schema %s", restoreFile)
+	}
+	return restoreFile, nil
+}
+
+// withKeyspace renames keyspace to target in the CREATE KEYSPACE
+// statement and in every name qualified with keyspace, such as tables,
+// types, indexes and views, of schema.
+func withKeyspace(schema, keyspace, target string) string {
+	name := `"?` + regexp.QuoteMeta(keyspace) + `"?`
+	create := regexp.MustCompile(`(CREATE KEYSPACE (?:IF NOT EXISTS )?)` + name + `(\s)`)
+	schema = create.ReplaceAllString(schema, "${1}"+target+"${2}")
+	qualified := regexp.MustCompile(`(^|[^\w"])` + name + `\.`)
+	return qualified.ReplaceAllString(schema, "${1}"+target+".")
+}
+
+// createPattern matches the start of statements creating schema objects.
+var createPattern = regexp.MustCompile(
+	`CREATE (KEYSPACE|TABLE|TYPE|INDEX|CUSTOM INDEX|MATERIALIZED VIEW|FUNCTION|AGGREGATE) (IF NOT EXISTS )?`)
+
+// withIfNotExists makes every statement of schema leave existing objects
+// alone.
+func withIfNotExists(schema string) string {
+	return createPattern.ReplaceAllString(schema, "CREATE $1 IF NOT EXISTS ")
+}
+
+// restoreKeyspace returns the keyspace a restore loads data into.
+func (p *Priam) restoreKeyspace() string {
+	if p.config.TargetKeyspace != "" {
+		return p.config.TargetKeyspace
+	}
+	return p.config.Keyspace
+}
+
+// withTableIDs adds the id every table had when snapshot was taken, as
+// recorded in the manifests of its chain, to the CREATE TABLE statements
+// of schema.
+func (p *Priam) withTableIDs(schema, snapshot string) (string, error) {
+	chain, err := p.hist.Chain(snapshot)
+	if err != nil {
+		return "", err
+	}
+	ids := make(map[string]string)
+	for _, s := range chain {
+		if m := p.hist.Manifest(s); m != nil {
+			for _, obj := range m.Objects {
+				if len(obj.TableID) == 32 {
+					ids[obj.Table] = obj.TableID
+				}
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("no table ids recorded for snapshot %s", snapshot)
+	}
+	return createTablePattern.ReplaceAllStringFunc(schema, func(stmt string) string {
+		table := createTablePattern.FindStringSubmatch(stmt)[1]
+		id, ok := ids[table]
+		if !ok {
+			return stmt
+		}
+		uuid := strings.Join([]string{id[:8], id[8:12], id[12:16], id[16:20], id[20:]}, "-")
+		return fmt.Sprintf("%sID = %s AND ", stmt, uuid)
+	}), nil
+}
+
+// tableDef holds the column types and primary key of a table.
+type tableDef struct {
+	columns map[string]string
+	key     string
+}
+
+// parseTables returns the definition of every table created by schema.
+func parseTables(schema string) map[string]*tableDef {
+	tables := make(map[string]*tableDef)
+	for _, m := range createTablePattern.FindAllStringSubmatch(schema, -1) {
+		def := &tableDef{columns: make(map[string]string)}
+		for _, item := range splitColumns(m[2]) {
+			item = strings.Join(strings.Fields(item), " ")
+			if item == "" {
+				continue
+			}
+			if strings.HasPrefix(item, "PRIMARY KEY") {
+				def.key = strings.Replace(strings.TrimPrefix(item, "PRIMARY KEY"), " ", "", -1)
+				continue
+			}
+			fields := strings.SplitN(item, " ", 2)
+			if len(fields) < 2 {
+				continue
+			}
+			if strings.HasSuffix(fields[1], " PRIMARY KEY") {
+				fields[1] = strings.TrimSuffix(fields[1], " PRIMARY KEY")
+				def.key = "(" + fields[0] + ")"
+			}
+			def.columns[fields[0]] = fields[1]
+		}
+		tables[m[1]] = def
+	}
+	return tables
+}
+
+// splitColumns splits the column definitions of a CREATE TABLE statement
+// at commas that are not part of a type or primary key.
+func splitColumns(defs string) []string {
+	var items []string
+	depth, start := 0, 0
+	for i, c := range defs {
+		switch c {
+		case '<', '(':
+			depth++
+		case '>', ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, defs[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, defs[start:])
+}
+
+// checkSchema makes sure the tables restored from snapshot fit the tables
+// that already exist in the keyspace restored into: they must have the
+// same primary key and every backed up column with the same type. Tables
+// that do not exist yet are created by the restore.
+func (p *Priam) checkSchema(host, snapshot string) error {
+	key, err := p.hist.SchemaKey(snapshot)
+	if err != nil {
+		return err
+	}
+	_, _, backedUp, err := p.readKey(key, true)
+	if err != nil {
+		return errors.Wrap(err, "error reading schema")
+	}
+	current, err := p.cassandra.DescribeKeyspace(host, p.restoreKeyspace())
+	if err != nil {
+		return err
+	}
+
+	existing := parseTables(current)
+	var problems []string
+	for table, def := range parseTables(string(backedUp)) {
+		live, ok := existing[table]
+		if !ok || !p.restoresTable(snapshot, table) {
+			continue
+		}
+		if live.key != def.key {
+			problems = append(problems, fmt.Sprintf("table %s has primary key %s, backed up with %s",
+				table, live.key, def.key))
+		}
+		for column, typ := range def.columns {
+			if liveType, ok := live.columns[column]; !ok {
+				problems = append(problems, fmt.Sprintf("table %s has no column %s", table, column))
+			} else if liveType != typ {
+				problems = append(problems, fmt.Sprintf("column %s.%s is %s, backed up as %s",
+					table, column, liveType, typ))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		for _, problem := range problems {
+			glog.Errorf("schema: %s", problem)
+		}
+		return fmt.Errorf("schema of keyspace %s is not compatible with snapshot %s",
+			p.restoreKeyspace(), snapshot)
+	}
+	return nil
+}
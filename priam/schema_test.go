@@ -0,0 +1,81 @@
+package priam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWithKeyspace(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{
+			name:   "keyspace and table",
+			schema: "CREATE KEYSPACE ks WITH replication = {'class': 'SimpleStrategy'};\nCREATE TABLE ks.t (id int PRIMARY KEY) WITH comment = '';",
+			want:   "CREATE KEYSPACE ks2 WITH replication = {'class': 'SimpleStrategy'};\nCREATE TABLE ks2.t (id int PRIMARY KEY) WITH comment = '';",
+		},
+		{
+			name:   "quoted and if not exists",
+			schema: `CREATE KEYSPACE IF NOT EXISTS "ks" WITH replication = {};` + "\n" + `CREATE TABLE "ks"."t" (id int PRIMARY KEY) WITH comment = '';`,
+			want:   `CREATE KEYSPACE IF NOT EXISTS ks2 WITH replication = {};` + "\n" + `CREATE TABLE ks2."t" (id int PRIMARY KEY) WITH comment = '';`,
+		},
+		{
+			name:   "types, indexes and views",
+			schema: "CREATE TYPE ks.address (city text);\nCREATE TABLE ks.t (id int PRIMARY KEY, a frozen<ks.address>) WITH comment = '';\nCREATE INDEX i ON ks.t (a);\nCREATE MATERIALIZED VIEW ks.v AS SELECT * FROM ks.t;",
+			want:   "CREATE TYPE ks2.address (city text);\nCREATE TABLE ks2.t (id int PRIMARY KEY, a frozen<ks2.address>) WITH comment = '';\nCREATE INDEX i ON ks2.t (a);\nCREATE MATERIALIZED VIEW ks2.v AS SELECT * FROM ks2.t;",
+		},
+		{
+			name:   "other keyspaces",
+			schema: "CREATE TABLE myks.t (id int PRIMARY KEY) WITH comment = '';\nCREATE TABLE ks_old.t (id int PRIMARY KEY) WITH comment = 'ks';",
+			want:   "CREATE TABLE myks.t (id int PRIMARY KEY) WITH comment = '';\nCREATE TABLE ks_old.t (id int PRIMARY KEY) WITH comment = 'ks';",
+		},
+	}
+	for _, test := range tests {
+		if got := withKeyspace(test.schema, "ks", "ks2"); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseTables(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   map[string]*tableDef
+	}{
+		{
+			name:   "inline primary key",
+			schema: "CREATE TABLE ks.t (\n    id int PRIMARY KEY,\n    name text\n) WITH comment = '';",
+			want: map[string]*tableDef{
+				"t": {columns: map[string]string{"id": "int", "name": "text"}, key: "(id)"},
+			},
+		},
+		{
+			name:   "compound primary key and collections",
+			schema: "CREATE TABLE IF NOT EXISTS ks.t (\n    a int,\n    b text,\n    m map<text, int>,\n    PRIMARY KEY ((a, b), m)\n) WITH CLUSTERING ORDER BY (m ASC);",
+			want: map[string]*tableDef{
+				"t": {columns: map[string]string{"a": "int", "b": "text", "m": "map<text, int>"}, key: "((a,b),m)"},
+			},
+		},
+		{
+			name:   "several tables",
+			schema: "CREATE TABLE ks.t1 (id int PRIMARY KEY) WITH comment = '';\nCREATE TYPE ks.u (x int);\nCREATE TABLE \"ks\".\"t2\" (id uuid PRIMARY KEY, v frozen<u>) WITH comment = '';",
+			want: map[string]*tableDef{
+				"t1": {columns: map[string]string{"id": "int"}, key: "(id)"},
+				"t2": {columns: map[string]string{"id": "uuid", "v": "frozen<u>"}, key: "(id)"},
+			},
+		},
+		{
+			name:   "no tables",
+			schema: "CREATE KEYSPACE ks WITH replication = {};",
+			want:   map[string]*tableDef{},
+		},
+	}
+	for _, test := range tests {
+		if got := parseTables(test.schema); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package priam
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Storage is implemented by every backend that can hold backup objects.
+// Keys follow the layout produced by getFileKey and are passed to the
+// backend unchanged. Each object may carry a small set of metadata
+// entries; metadata keys are always lower case.
+type Storage interface {
+	// Put stores everything read from r under key along with metadata.
+	Put(key string, r io.Reader, meta map[string]string) error
+
+	// Get returns a stream of the object stored under key and its
+	// metadata. The caller must close the returned reader.
+	Get(key string) (io.ReadCloser, map[string]string, error)
+
+	// List returns all objects whose key begins with prefix.
+	List(prefix string) ([]*ObjectInfo, error)
+
+	// Delete removes the object stored under key.
+	Delete(key string) error
+
+	// Stat returns information, including metadata, about the object
+	// stored under key.
+	Stat(key string) (*ObjectInfo, error)
+}
+
+// BatchDeleter is implemented by storage backends that can delete many
+// objects in one request.
+type BatchDeleter interface {
+	// DeleteKeys removes all objects stored under keys.
+	DeleteKeys(keys []string) error
+}
+
+// Copier is implemented by storage backends that can copy an object,
+// along with its metadata, without it leaving the storage.
+type Copier interface {
+	// Copy stores a copy of the object under src as dst.
+	Copy(src, dst string) error
+}
+
+// ObjectInfo describes an object held by a storage backend. Metadata is
+// only filled in by Stat.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// NewStorage returns the storage backend selected by the storage
+// config parameter.
+func NewStorage(config *Config) (Storage, error) {
+	switch config.Storage {
+	case "", "s3":
+		return NewS3(config)
+	case "local":
+		return NewLocal(config), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend '%s'", config.Storage)
+}
@@ -0,0 +1,94 @@
+package priam
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"path"
+)
+
+// partialRestore returns true if only some tables of the keyspace are
+// restored, either because the tables or exclude-tables config
+// parameters are set or because a backup in the chain of snapshot only
+// holds some tables.
+func (p *Priam) partialRestore(snapshot string) bool {
+	if p.config.Tables != "" || p.config.ExcludeTables != "" {
+		return true
+	}
+	chain, _ := p.hist.Chain(snapshot)
+	for _, s := range chain {
+		if m := p.hist.Manifest(s); m != nil && (len(m.Tables) > 0 || len(m.ExcludeTables) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoresTable returns true if table is selected both by the restore
+// table filters and by the filters of every backup in the chain of
+// snapshot.
+func (p *Priam) restoresTable(snapshot, table string) bool {
+	if !tableSelected(table, splitList(p.config.Tables), splitList(p.config.ExcludeTables)) {
+		return false
+	}
+	chain, _ := p.hist.Chain(snapshot)
+	for _, s := range chain {
+		if m := p.hist.Manifest(s); m != nil && !tableSelected(table, m.Tables, m.ExcludeTables) {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreKeys returns the data keys of snapshot and its parents that
+// belong to restored tables.
+func (p *Priam) restoreKeys(snapshot string) ([]string, error) {
+	keys, err := p.hist.Keys(snapshot)
+	if err != nil || !p.partialRestore(snapshot) {
+		return keys, err
+	}
+	var selected []string
+	for _, key := range keys {
+		if p.restoresTable(snapshot, tableName(path.Base(path.Dir(key)))) {
+			selected = append(selected, key)
+		}
+	}
+	return selected, nil
+}
+
+// restoreTables returns the tables of the backed up schema of snapshot
+// that are restored.
+func (p *Priam) restoreTables(snapshot string) ([]string, error) {
+	key, err := p.hist.SchemaKey(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	_, _, schema, err := p.readKey(key, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading schema")
+	}
+	var tables []string
+	for _, m := range createTablePattern.FindAllStringSubmatch(string(schema), -1) {
+		if p.restoresTable(snapshot, m[1]) {
+			tables = append(tables, m[1])
+		}
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no tables of snapshot %s selected for restore", snapshot)
+	}
+	return tables, nil
+}
+
+// truncateTables removes all data from tables of the keyspace being
+// restored.
+func (p *Priam) truncateTables(host string, tables []string) error {
+	for _, table := range tables {
+		glog.Infof("truncating table: %s.%s", p.restoreKeyspace(), table)
+		cmd := fmt.Sprintf("echo 'TRUNCATE %s.%s;' | %s",
+			p.restoreKeyspace(), table, p.config.CqlshPath)
+		if out, err := p.agent.Run(host, cmd); err != nil {
+			return errors.Wrapf(err, "error truncating %s with output %s", table, out)
+		}
+	}
+	return nil
+}
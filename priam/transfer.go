@@ -0,0 +1,374 @@
+package priam
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadFiles uploads a list of files from host to storage, running up
+// to file-parallelism uploads at a time, and returns their manifest
+// entries.
+func (p *Priam) uploadFiles(parent, timestamp, host string, files []string) ([]*ManifestObject, error) {
+	glog.Infof("uploading files from %s to %s...", host, p.config.Storage)
+	var mu sync.Mutex
+	var objects []*ManifestObject
+	err := parallel(p.config.FileParallelism, files, func(file string) error {
+		key := p.getFileKey(parent, timestamp, host, file)
+		upload := p.uploadFile
+		if p.config.Dedup {
+			upload = p.uploadBlob
+		}
+		obj, err := upload(host, file, key)
+		if err != nil {
+			return err
+		}
+		obj.Host = host
+		obj.DataDir, obj.Table, obj.TableID = parseDataFile(file)
+		mu.Lock()
+		objects = append(objects, obj)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// uploadFile compresses, and encrypts if configured, a file on host and
+// uploads it to storage.
+func (p *Priam) uploadFile(host, file, key string) (*ManifestObject, error) {
+	glog.Infof("upload key: %s", key)
+
+	// read bytes from file@host
+	r, err := p.agent.ReadFile(host, file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s:%s", host, file)
+	}
+
+	obj, err := p.putObject(key, r, p.codec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error uploading %s:%s", host, file)
+	}
+	obj.File = path.Base(file)
+	return obj, nil
+}
+
+// putObject compresses r with codec, encrypts it if configured and
+// stores it under key. The returned manifest entry records the size and
+// checksum of the original contents and the size as stored.
+func (p *Priam) putObject(key string, r io.Reader, codec *Codec) (*ManifestObject, error) {
+
+	// encrypt compressed stream if configured
+	reader, writer := io.Pipe()
+	var ew io.WriteCloser = writer
+	meta := make(map[string]string)
+	if p.crypt != nil {
+		cw, cryptMeta, err := p.crypt.Encrypt(writer)
+		if err != nil {
+			return nil, errors.Wrap(err, "error encrypting")
+		}
+		ew = cw
+		for k, v := range cryptMeta {
+			meta[k] = v
+		}
+	}
+
+	// compress files before uploading
+	cw, codecMeta, err := codec.Writer(ew, p.config.CompressionLevel)
+	if err != nil {
+		return nil, errors.Wrap(err, "error compressing")
+	}
+	for k, v := range codecMeta {
+		meta[k] = v
+	}
+
+	h := sha256.New()
+	var size int64
+	go func() {
+		n, err := io.Copy(cw, io.TeeReader(r, h))
+		size = n
+		if err == nil {
+			err = cw.Close()
+		}
+		if err == nil && ew != writer {
+			err = ew.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	// upload file
+	stored := &countingReader{r: reader}
+	if err = p.storage.Put(key, stored, meta); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return &ManifestObject{
+		Key:            strings.TrimPrefix(key, "/"),
+		Size:           size,
+		CompressedSize: stored.n,
+		Sha256:         hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// getFileKey creates a unique key for backup file that would be uploaded
+// to storage.
+func (p *Priam) getFileKey(parent, timestamp, host, file string) string {
+	dir, base := path.Split(path.Clean(file))
+	dir, _ = path.Split(path.Clean(dir))
+	if !p.config.Incremental {
+		dir, _ = path.Split(path.Clean(dir))
+	}
+	return fmt.Sprintf("/%s/%s/%s/%s/%s%s%s%s",
+		p.config.AwsBasePath, p.config.Keyspace, parent,
+		timestamp, host, dir, base, p.codec.Extension)
+}
+
+// schemaKey returns the key under which the keyspace schema of a
+// snapshot is uploaded.
+func (p *Priam) schemaKey(parent, timestamp string) string {
+	return fmt.Sprintf("/%s/%s/%s/%s/%s.schema%s",
+		p.config.AwsBasePath, p.config.Keyspace,
+		parent, timestamp, p.config.Keyspace, p.codec.Extension)
+}
+
+// downloadKeys downloads a list of keys from storage to local machine,
+// running up to download-parallelism downloads at a time. Files already
+// downloaded by an earlier run are kept, so an interrupted restore can
+// be rerun without fetching everything again.
+func (p *Priam) downloadKeys(keys []string, prefix string) (map[string]string, error) {
+	glog.Infof("downloading %d keys", len(keys))
+	var mu sync.Mutex
+	files := make(map[string]string)
+	err := parallel(p.config.DownloadWorkers, keys, func(key string) error {
+		file, err := p.downloadKeyWithRetry(key, prefix)
+		if err != nil {
+			return errors.Wrapf(err, "error downloading %s", key)
+		}
+		mu.Lock()
+		files[key] = file
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// downloadKeyWithRetry calls downloadKey up to retries additional times
+// when it fails.
+func (p *Priam) downloadKeyWithRetry(key, prefix string) (string, error) {
+	var err error
+	for attempt := 0; attempt <= p.config.Retries; attempt++ {
+		if attempt > 0 {
+			glog.Warningf("retrying download of %s (%d/%d): %v",
+				key, attempt, p.config.Retries, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var file string
+		if file, err = p.downloadKey(key, prefix); err == nil {
+			return file, nil
+		}
+	}
+	return "", err
+}
+
+// downloadState records which object a downloaded file came from and
+// what was written, so that a later run can tell if it is complete. Key
+// is the key the contents are stored under, which is the shared blob for
+// deduplicated files.
+type downloadState struct {
+	Key        string    `json:"key"`
+	ObjectSize int64     `json:"object_size"`
+	Modified   time.Time `json:"modified"`
+	FileSize   int64     `json:"file_size"`
+	Sha256     string    `json:"sha256"`
+}
+
+// stateFile returns the name of the file holding download state of file.
+func stateFile(file string) string {
+	return path.Join(path.Dir(file), ".priam-"+path.Base(file))
+}
+
+// downloadKey downloads, decrypts and decompresses a single key from
+// storage into a file under prefix and returns the file name. If the
+// file was already downloaded from the same object and still matches
+// the recorded size and checksum the download is skipped.
+func (p *Priam) downloadKey(key, prefix string) (string, error) {
+
+	info, err := p.storage.Stat(p.hist.StorageKey(key))
+	if err != nil {
+		return "", err
+	}
+	codec, err := codecForKey(key, info.Metadata)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading %s", key)
+	}
+	fileName := strings.TrimSuffix(fmt.Sprintf("%s/%s", prefix, key), codec.Extension)
+
+	// skip files completed by a previous run
+	if p.downloaded(fileName, info) {
+		glog.V(2).Infof("already downloaded key: %s", key)
+		return fileName, nil
+	}
+	glog.V(2).Infof("download key: %s", key)
+
+	r, _, err := p.openKey(key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	dir := path.Dir(fileName)
+	err = os.MkdirAll(dir, os.ModeDir|os.ModePerm)
+	if err != nil {
+		return "", errors.Wrapf(err, "error creading dir %s", dir)
+	}
+
+	// write to a temporary file so a partial download never looks complete
+	tmpName := fileName + ".partial"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return "", errors.Wrap(err, "error opening file")
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, h), r)
+	if err != nil {
+		file.Close()
+		return "", errors.Wrap(err, "error writing file")
+	}
+	if err = file.Close(); err != nil {
+		return "", errors.Wrap(err, "error closing file")
+	}
+	if err = os.Rename(tmpName, fileName); err != nil {
+		return "", errors.Wrap(err, "error renaming file")
+	}
+
+	// record download state
+	state := &downloadState{
+		Key:        info.Key,
+		ObjectSize: info.Size,
+		Modified:   info.LastModified,
+		FileSize:   n,
+		Sha256:     hex.EncodeToString(h.Sum(nil)),
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding download state")
+	}
+	if err = ioutil.WriteFile(stateFile(fileName), data, 0644); err != nil {
+		return "", errors.Wrap(err, "error writing download state")
+	}
+	return fileName, nil
+}
+
+// downloaded returns true if fileName was completely downloaded from the
+// object described by info.
+func (p *Priam) downloaded(fileName string, info *ObjectInfo) bool {
+	data, err := ioutil.ReadFile(stateFile(fileName))
+	if err != nil {
+		return false
+	}
+	var state downloadState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return false
+	}
+	if state.Key != info.Key || state.ObjectSize != info.Size ||
+		!state.Modified.Equal(info.LastModified) {
+		return false
+	}
+
+	// check local file against recorded size and checksum
+	fi, err := os.Stat(fileName)
+	if err != nil || fi.Size() != state.FileSize {
+		return false
+	}
+	sum, err := fileSha256(fileName)
+	if err != nil {
+		return false
+	}
+	return sum == state.Sha256
+}
+
+// fileSha256 returns the hex encoded sha256 checksum of a local file.
+func fileSha256(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openKey returns a stream of the original contents of key, decrypting
+// and decompressing it according to its metadata, along with the codec
+// it was compressed with.
+func (p *Priam) openKey(key string) (io.ReadCloser, *Codec, error) {
+	r, meta, err := p.storage.Get(p.hist.StorageKey(key))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error downloading key: %s", key)
+	}
+
+	dr, err := p.crypt.Decrypt(key, r, meta)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+
+	codec, err := codecForKey(key, meta)
+	if err != nil {
+		r.Close()
+		return nil, nil, errors.Wrapf(err, "error reading %s", key)
+	}
+	cr, err := codec.Reader(dr)
+	if err != nil {
+		r.Close()
+		return nil, nil, errors.Wrapf(err, "error creating %s reader for %s", codec.Name, key)
+	}
+	return &keyReader{Reader: cr, closers: []io.Closer{cr, r}}, codec, nil
+}
+
+// keyReader reads a decoded key and closes every stage of the pipeline.
+type keyReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (k *keyReader) Close() error {
+	var err error
+	for _, c := range k.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
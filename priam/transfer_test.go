@@ -0,0 +1,77 @@
+package priam
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	crypt := testCrypt(t, dir, "key")
+
+	data := make([]byte, 3*cryptChunkSize+7)
+	rand.Read(data)
+	tests := []struct {
+		name  string
+		codec string
+		crypt *Crypt
+	}{
+		{"gzip", "gzip", nil},
+		{"none", "none", nil},
+		{"gzip encrypted", "gzip", crypt},
+		{"none encrypted", "none", crypt},
+	}
+	for i, test := range tests {
+		config := &Config{
+			StoragePath: filepath.Join(dir, "storage"),
+			TempDir:     filepath.Join(dir, "restore"),
+		}
+		codec, err := NewCodec(test.codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &Priam{config: config, codec: codec, crypt: test.crypt, storage: NewLocal(config)}
+		key := "base/ks/2026-03-01_000000/2026-03-01_000000/10.0.0.1/t-1/mc-" +
+			string(rune('a'+i)) + "-big-Data.db" + codec.Extension
+
+		obj, err := p.putObject(key, bytes.NewReader(data), codec)
+		if err != nil {
+			t.Errorf("%s: upload: %v", test.name, err)
+			continue
+		}
+		if obj.Size != int64(len(data)) {
+			t.Errorf("%s: size %d, want %d", test.name, obj.Size, len(data))
+		}
+
+		size, sum, _, err := p.readKey(key, false)
+		if err != nil {
+			t.Errorf("%s: read: %v", test.name, err)
+			continue
+		}
+		if size != obj.Size || sum != obj.Sha256 {
+			t.Errorf("%s: read %d bytes with checksum %s, uploaded %d bytes with checksum %s",
+				test.name, size, sum, obj.Size, obj.Sha256)
+		}
+
+		file, err := p.downloadKey(key, config.TempDir)
+		if err != nil {
+			t.Errorf("%s: download: %v", test.name, err)
+			continue
+		}
+		downloaded, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(downloaded, data) {
+			t.Errorf("%s: downloaded data does not match", test.name)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package priam
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// requiredComponents must exist for every sstable, in addition to the
+// components listed in its TOC.
+var requiredComponents = []string{"Data.db", "Statistics.db", "TOC.txt"}
+
+// Verify checks that every object needed to restore a snapshot exists,
+// decodes cleanly and matches the size and checksum in its manifest, and
+// that every sstable has a complete set of components.
+func (p *Priam) Verify() error {
+
+	snapshot, err := p.selectSnapshot()
+	if err != nil {
+		return err
+	}
+	glog.Infof("verifying snapshot: %s", snapshot)
+
+	keys, err := p.hist.Keys(snapshot)
+	if err != nil {
+		return errors.Wrap(err, "failed to get all keys")
+	}
+
+	// manifest entries of every snapshot in the chain
+	objects := make(map[string]*ManifestObject)
+	chain, err := p.hist.Chain(snapshot)
+	if err != nil {
+		return err
+	}
+	for _, ts := range chain {
+		if m := p.hist.Manifest(ts); m != nil {
+			for _, obj := range m.Objects {
+				objects[obj.Key] = obj
+			}
+		} else {
+			glog.Warningf("snapshot %s has no manifest, checksums can not be verified", ts)
+		}
+	}
+
+	var mu sync.Mutex
+	var problems []string
+	tocs := make(map[string][]byte)
+	report := func(format string, args ...interface{}) {
+		mu.Lock()
+		problems = append(problems, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+
+	// schema must be readable
+	if schemaKey, err := p.hist.SchemaKey(snapshot); err != nil {
+		report("%v", err)
+	} else if _, _, _, err := p.readKey(schemaKey, false); err != nil {
+		report("schema %s: %v", schemaKey, err)
+	}
+	if m := p.hist.Manifest(snapshot); m != nil {
+		for name, key := range m.ClusterSchema {
+			if _, _, _, err := p.readKey(key, false); err != nil {
+				report("%s %s: %v", name, key, err)
+			}
+		}
+		for name, reason := range m.ClusterSchemaErrors {
+			report("%s was not backed up: %s", name, reason)
+		}
+	}
+
+	// check every object
+	parallel(p.config.DownloadWorkers, keys, func(key string) error {
+		glog.V(2).Infof("verify key: %s", key)
+		isTOC := strings.HasSuffix(sstableFile(key), "-TOC.txt")
+		size, sum, toc, err := p.readKey(key, isTOC)
+		if err != nil {
+			report("%s: %v", key, err)
+			return nil
+		}
+		if obj, ok := objects[key]; ok {
+			if obj.Size != size {
+				report("%s: size %d does not match manifest size %d", key, size, obj.Size)
+			}
+			if obj.Sha256 != sum {
+				report("%s: checksum %s does not match manifest checksum %s", key, sum, obj.Sha256)
+			}
+		}
+		if isTOC {
+			mu.Lock()
+			tocs[key] = toc
+			mu.Unlock()
+		}
+		return nil
+	})
+
+	// check sstable components
+	for _, problem := range checkComponents(keys, tocs) {
+		report("%s", problem)
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		for _, problem := range problems {
+			glog.Errorf("verify: %s", problem)
+		}
+		return fmt.Errorf("snapshot %s failed verification with %d problems",
+			snapshot, len(problems))
+	}
+	glog.Infof("verified %d objects of snapshot %s", len(keys), snapshot)
+	return nil
+}
+
+// readKey reads the original contents of key and returns its size and
+// sha256 checksum, along with the contents if keep is set.
+func (p *Priam) readKey(key string, keep bool) (int64, string, []byte, error) {
+	r, _, err := p.openKey(key)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	var buf bytes.Buffer
+	var w io.Writer = h
+	if keep {
+		w = io.MultiWriter(h, &buf)
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return 0, "", nil, errors.Wrap(err, "error decoding")
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), buf.Bytes(), nil
+}
+
+// sstableFile returns the file name of a data key with any compression
+// extension removed.
+func sstableFile(key string) string {
+	base := path.Base(key)
+	for _, codec := range codecs {
+		if codec.Extension != "" && strings.HasSuffix(base, codec.Extension) {
+			return strings.TrimSuffix(base, codec.Extension)
+		}
+	}
+	return base
+}
+
+// sstableID identifies an sstable of a table on a host, independent of
+// which snapshot in a chain holds it.
+func sstableID(key string) (string, string) {
+	parts := keyParts(key)
+	file := sstableFile(key)
+	i := strings.LastIndex(file, "-")
+	if i < 0 {
+		return "", ""
+	}
+	dir := strings.Join(parts[4:len(parts)-1], "/")
+	return path.Join(dir, file[:i]), file[i+1:]
+}
+
+// checkComponents returns a problem for every sstable in keys that is
+// missing a required component or a component listed in its TOC.
+func checkComponents(keys []string, tocs map[string][]byte) []string {
+	components := make(map[string]map[string]bool)
+	listed := make(map[string][]string)
+	for _, key := range keys {
+		id, component := sstableID(key)
+		if id == "" {
+			continue
+		}
+		if components[id] == nil {
+			components[id] = make(map[string]bool)
+		}
+		components[id][component] = true
+		if toc, ok := tocs[key]; ok {
+			for _, line := range strings.Split(string(toc), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					listed[id] = append(listed[id], line)
+				}
+			}
+		}
+	}
+
+	var problems []string
+	for id, have := range components {
+		want := append(append([]string{}, requiredComponents...), listed[id]...)
+		if len(listed[id]) == 0 && !have["Partitions.db"] {
+			want = append(want, "Index.db")
+		}
+		for _, component := range want {
+			if !have[component] {
+				problems = append(problems,
+					fmt.Sprintf("sstable %s is missing %s", id, component))
+				have[component] = true
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,61 @@
+package priam
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCheckComponents(t *testing.T) {
+	prefix := "base/ks/2026-03-01_000000/2026-03-01_000000/10.0.0.1/data/ks/t-1/"
+	id := "10.0.0.1/data/ks/t-1/mc-1-big"
+	tests := []struct {
+		name     string
+		keys     []string
+		tocs     map[string][]byte
+		problems []string
+	}{
+		{
+			name: "complete with toc",
+			keys: []string{"mc-1-big-Data.db.gz", "mc-1-big-Statistics.db.gz", "mc-1-big-TOC.txt.gz",
+				"mc-1-big-Index.db.gz", "mc-1-big-Filter.db.gz"},
+			tocs: map[string][]byte{
+				"mc-1-big-TOC.txt.gz": []byte("Data.db\nStatistics.db\nTOC.txt\nIndex.db\nFilter.db\n"),
+			},
+		},
+		{
+			name: "missing component listed in toc",
+			keys: []string{"mc-1-big-Data.db", "mc-1-big-Statistics.db", "mc-1-big-TOC.txt",
+				"mc-1-big-Index.db"},
+			tocs: map[string][]byte{
+				"mc-1-big-TOC.txt": []byte("Data.db\nStatistics.db\nTOC.txt\nIndex.db\nFilter.db\n"),
+			},
+			problems: []string{"sstable " + id + " is missing Filter.db"},
+		},
+		{
+			name:     "missing required components without toc",
+			keys:     []string{"mc-1-big-Data.db"},
+			problems: []string{"sstable " + id + " is missing Index.db", "sstable " + id + " is missing Statistics.db", "sstable " + id + " is missing TOC.txt"},
+		},
+		{
+			name: "trie indexed sstable",
+			keys: []string{"mc-1-big-Data.db", "mc-1-big-Statistics.db", "mc-1-big-TOC.txt",
+				"mc-1-big-Partitions.db"},
+		},
+	}
+	for _, test := range tests {
+		var keys []string
+		for _, key := range test.keys {
+			keys = append(keys, prefix+key)
+		}
+		tocs := make(map[string][]byte)
+		for key, toc := range test.tocs {
+			tocs[prefix+key] = toc
+		}
+		problems := checkComponents(keys, tocs)
+		sort.Strings(problems)
+		if !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%s: got %v, want %v", test.name, problems, test.problems)
+		}
+	}
+}